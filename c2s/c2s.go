@@ -29,6 +29,8 @@ import (
 	"github.com/maxymania/synapse/proto"
 	"fmt"
 	"sync"
+	"strconv"
+	"strings"
 )
 
 var eAuthFailed = fmt.Errorf("c2s: Auth Failed")
@@ -37,6 +39,8 @@ var eCryptoError = fmt.Errorf("c2s: crypto error")
 
 var eProtocolError = fmt.Errorf("c2s: protocol error")
 
+var eNoDocument = fmt.Errorf("c2s: entry is not a document")
+
 func elookup(elems []bson.Element,n string) (val bson.Value) {
 	for _,elem := range elems {
 		if string(elem.KeyBytes())!=n { continue }
@@ -75,6 +79,20 @@ type Srv_Token interface{
 	Domain() string
 }
 
+// Optionally implemented by a Srv_Token, that can tell, why it was rejected.
+type Srv_Reason interface{
+	Reason() error
+}
+
+/*
+Optionally implemented by a Srv_Token, whose status can change after the login.
+The Server uses it to push the final status to the client.
+*/
+type Srv_Notify interface{
+	// Returns a channel, that is closed, once the status is no longer Pending.
+	Done() <-chan int
+}
+
 type Srv_Auth interface{
 	Login(pub []byte, domain string) Srv_Token
 }
@@ -82,7 +100,8 @@ type Srv_Auth interface{
 type Srv_Queries interface{
 	RetractAll(tok Srv_Token)
 	
-	Publish(tok Srv_Token, doc bson.Document)
+	// Publishes an entry. The returned error is reported back to the publisher.
+	Publish(tok Srv_Token, doc bson.Document) error
 	Retract(tok Srv_Token, doc bson.Document)
 	
 	Query(tok Srv_Token, terms bson.Document, max int) bson.Document
@@ -103,9 +122,34 @@ func (s *Server) Validate() bool {
 
 type connServer struct {
 	*Server
-	pc  *proto.Conn
-	sa  proto.ServerAuth
-	tok Srv_Token
+	pc    *proto.Conn
+	sa    proto.ServerAuth
+	tok   Srv_Token
+	wm    sync.Mutex
+	alive chan int
+}
+
+func (s *connServer) write(doc bson.Document) error {
+	s.wm.Lock(); defer s.wm.Unlock()
+	return s.pc.WriteDocument(doc)
+}
+
+func (s *connServer) statusDoc(key string) bson.Document {
+	db := bson.NewDocumentBuilder().
+		AppendInt32(key,int32(s.tok.Status()))
+	if r,ok := s.tok.(Srv_Reason); ok {
+		if why := r.Reason(); why!=nil { db.AppendString("reason",why.Error()) }
+	}
+	return db.Build()
+}
+
+// Waits for the token to leave the Pending state and pushes the new status to the client.
+func (s *connServer) notify(done <-chan int) {
+	select {
+	case <- done:
+	case <- s.alive: return
+	}
+	s.write(s.statusDoc("notify"))
 }
 
 
@@ -128,21 +172,31 @@ func (s *connServer) handshake() (err error) {
 }
 
 func (s *connServer) ready(msg bson.Document, elems []bson.Element) (err error) {
-	status := s.tok.Status()
-	
-	res := bson.NewDocumentBuilder().
-		AppendInt32("status",int32(status)).
-		Build()
-	err = s.pc.WriteDocument(res)
+	err = s.write(s.statusDoc("status"))
 	return
 }
 
 func (s *connServer) publish(msg bson.Document, elems []bson.Element) (err error) {
-	for _,elem := range elems {
+	n := int32(0)
+	rej := bson.NewDocumentBuilder()
+	for i,elem := range elems {
 		arr,ok := elem.Value().DocumentOK()
-		if !ok { continue }
-		s.Query.Publish(s.tok, arr)
+		if !ok {
+			rej.AppendString(strconv.Itoa(i),eNoDocument.Error())
+			continue
+		}
+		perr := s.Query.Publish(s.tok, arr)
+		if perr!=nil {
+			rej.AppendString(strconv.Itoa(i),perr.Error())
+			continue
+		}
+		n++
 	}
+	res := bson.NewDocumentBuilder().
+		AppendInt32("published",n).
+		AppendDocument("rejected",rej.Build()).
+		Build()
+	err = s.write(res)
 	return
 }
 
@@ -158,7 +212,7 @@ func (s *connServer) retract(msg bson.Document, elems []bson.Element) (err error
 func (s *connServer) query(msg bson.Document, elems []bson.Element) (err error) {
 	if s.tok.Status()==Rejected {
 		resp := bson.NewDocumentBuilder().Build()
-		err = s.pc.WriteDocument(resp)
+		err = s.write(resp)
 		return
 	}
 	terms,ok := elems[0].Value().DocumentOK()
@@ -166,7 +220,7 @@ func (s *connServer) query(msg bson.Document, elems []bson.Element) (err error)
 	i := int32(1<<10)
 	if j,ok := elookup(elems,"max").Int32OK() ; ok { i = j }
 	resp := s.Query.Query(s.tok,terms,int(i))
-	err = s.pc.WriteDocument(resp)
+	err = s.write(resp)
 	return
 }
 
@@ -195,6 +249,7 @@ func (s *Server) prepare(conn io.ReadWriteCloser) *connServer {
 	t.Server = s
 	t.pc = proto.NewConn(conn,s.Arena)
 	t.sa.Rand = s.Rand
+	t.alive = make(chan int)
 	return t
 }
 
@@ -205,6 +260,10 @@ func (s *Server) Serve(conn io.ReadWriteCloser) {
 	if err!=nil { return }
 	t.tok = t.Auth.Login(t.sa.Pub,t.sa.Domain)
 	if t.tok==nil { return }
+	defer close(t.alive)
+	if n,ok := t.tok.(Srv_Notify); ok && t.tok.Status()==Pending {
+		go t.notify(n.Done())
+	}
 	defer t.Query.RetractAll(t.tok)
 	for {
 		err = t.serve()
@@ -227,10 +286,38 @@ func (cc *ClientContext) Validate() bool {
 	return len(cc.KP.Pub)>0 && len(cc.KP.Pri)>0
 }
 
+// A rejected entry of a Client.Publish call.
+type Rejection struct{
+	Index  int
+	Reason string
+}
+
+// Returned by Client.Publish, if the server rejected some of the entries.
+type PublishError []Rejection
+
+func (p PublishError) Error() string {
+	s := make([]string,len(p))
+	for i,r := range p { s[i] = fmt.Sprintf("#%d: %s",r.Index,r.Reason) }
+	return "c2s: rejected entries: "+strings.Join(s,", ")
+}
+
+func d2rejections(d bson.Document) (p PublishError) {
+	elems,_ := d.Elements()
+	for _,elem := range elems {
+		i,err := strconv.Atoi(elem.Key())
+		if err!=nil { continue }
+		r,_ := elem.Value().StringValueOK()
+		p = append(p,Rejection{i,r})
+	}
+	return
+}
+
 type Client struct{
 	*ClientContext
 	conn *proto.Conn
 	m sync.Mutex
+	resp chan bson.Document
+	push chan Status
 }
 func (c *Client) lock() func() {
 	c.m.Lock(); return c.m.Unlock
@@ -263,20 +350,65 @@ func (cc *ClientContext) NewClient(conn io.ReadWriteCloser) (cli *Client,err err
 	cli = &Client{ClientContext:cc,conn:proto.NewConn(conn,cc.Arena)}
 	err = cli.handshake()
 	if cfatal(&cli,err) { return }
+	cli.resp = make(chan bson.Document,1)
+	cli.push = make(chan Status,1)
+	go cli.reader()
 	return
 }
 
+// Separates pushed status messages from responses.
+func (c *Client) reader() {
+	defer close(c.push)
+	defer close(c.resp)
+	for {
+		doc,err := c.conn.ReadDocument()
+		if err!=nil { return }
+		elem,err := doc.IndexErr(0)
+		if err!=nil || elem.Key()!="notify" {
+			c.resp <- doc
+			continue
+		}
+		i,_ := elem.Value().Int32OK()
+		c.conn.Free(doc)
+		select {
+		case <- c.push:
+		default:
+		}
+		c.push <- Status(i)
+	}
+}
+
+func (c *Client) readResponse() (bson.Document,error) {
+	doc,ok := <- c.resp
+	if !ok { return nil,io.EOF }
+	return doc,nil
+}
+
+/*
+Returns a channel, that receives the status, once the server pushes it.
+The channel is closed, when the connection is lost.
+*/
+func (c *Client) Pushed() <-chan Status { return c.push }
+
 func (c *Client) Close() error { return c.conn.Close() }
 func (c *Client) Status() (Status,error) {
+	s,_,err := c.StatusReason()
+	return s,err
+}
+
+// Like Status, but also returns the reason, why the server rejected the login, if any.
+func (c *Client) StatusReason() (Status,string,error) {
 	defer c.lock()()
 	doc := bson.NewDocumentBuilder().AppendString("ready","").Build()
 	err := c.conn.WriteDocument(doc)
-	if err!=nil { return 0,err }
-	resp,err := c.conn.ReadDocument()
-	if err!=nil { return 0,err }
+	if err!=nil { return 0,"",err }
+	resp,err := c.readResponse()
+	if err!=nil { return 0,"",err }
+	defer c.conn.Free(resp)
 	i,ok := resp.Lookup("status").Int32OK()
-	if !ok { return 0,eProtocolError }
-	return Status(i),nil
+	if !ok { return 0,"",eProtocolError }
+	why,_ := resp.Lookup("reason").StringValueOK()
+	return Status(i),why,nil
 }
 
 func (c *Client) RetractAll() error {
@@ -285,6 +417,10 @@ func (c *Client) RetractAll() error {
 	return c.conn.WriteDocument(doc)
 }
 
+/*
+Publishes the given entries. If the server rejected some of them,
+a PublishError is returned.
+*/
 func (c *Client) Publish(files []bson.Document) error {
 	defer c.lock()()
 	if len(files)==0 { return nil }
@@ -292,7 +428,15 @@ func (c *Client) Publish(files []bson.Document) error {
 	for _,f := range files[1:] {
 		db = db.AppendDocument("",f)
 	}
-	return c.conn.WriteDocument(db.Build())
+	err := c.conn.WriteDocument(db.Build())
+	if err!=nil { return err }
+	resp,err := c.readResponse()
+	if err!=nil { return err }
+	defer c.conn.Free(resp)
+	rej,ok := resp.Lookup("rejected").DocumentOK()
+	if !ok { return eProtocolError }
+	if p := d2rejections(rej); len(p)>0 { return p }
+	return nil
 }
 
 func (c *Client) Retract(files []bson.Document) error {
@@ -312,7 +456,7 @@ func (c *Client) Query(terms bson.Document,max int) ([]bson.Element,error) {
 	doc := db.Build()
 	err := c.conn.WriteDocument(doc)
 	if err!=nil { return nil,err }
-	doc,err = c.conn.ReadDocument()
+	doc,err = c.readResponse()
 	if err!=nil { return nil,err }
 	elems,err := doc.Elements()
 	bdClones(elems)
@@ -66,8 +66,14 @@ func unify(t, words []string) []string {
 	return t
 }
 
+// Domain, directory and file. The file may contain "/", if it is in a subdirectory.
 type Path [3]string
 
+// The key of a path in an index. Unlike "/", the separator can't appear in any of the parts.
+func pathKey(p Path) string {
+	return p[0]+"\x00"+p[1]+"\x00"+p[2]
+}
+
 func (p *Path) CreateMeta() bson.Document {
 	return bson.NewDocumentBuilder().
 		AppendString("",p[1]).
@@ -95,6 +101,14 @@ type Dir interface{
 }
 type FTSI struct{
 	Dir
+	
+	// The schema for published entries. If nil, DefaultSchema is used.
+	Schema *Schema
+}
+
+func (f *FTSI) schema() *Schema {
+	if f.Schema==nil { return DefaultSchema }
+	return f.Schema
 }
 
 
@@ -104,10 +118,13 @@ func (f *FTSI) RetractAll(tok c2s.Srv_Token) {
 	f.DelAll(dom)
 }
 
-func (f *FTSI) Publish(tok c2s.Srv_Token, doc bson.Document) {
-	if tok.Status()!=c2s.Accepted { return }
-	elems,_ := doc.Elements()
-	if len(elems) < 2 { return }
+func (f *FTSI) Publish(tok c2s.Srv_Token, doc bson.Document) error {
+	if tok.Status()!=c2s.Accepted { return ENotAccepted }
+	sch := f.schema()
+	elems,err := doc.Elements()
+	if err!=nil { return err }
+	err = sch.checkFields(elems)
+	if err!=nil { return err }
 	var pth Path
 	pth[0] = tok.Domain()
 	pth[1],_ = elems[0].Value().StringValueOK()
@@ -122,7 +139,10 @@ func (f *FTSI) Publish(tok c2s.Srv_Token, doc bson.Document) {
 		kwds = append(kwds,tmp...)
 	}
 	kwds = unify(kwds,kwds)
+	err = sch.checkKeywords(kwds)
+	if err!=nil { return err }
 	f.PutTrack(pth,kwds,doc)
+	return nil
 }
 
 func (f *FTSI) Retract(tok c2s.Srv_Token, doc bson.Document) {
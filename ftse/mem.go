@@ -75,7 +75,7 @@ func (m *MemDir) PutTrack(path Path, keys []string, doc []byte) {
 	defer m.lock()()
 	var i uint32
 	
-	p := path[0]+"/"+path[1]+"/"+path[2]
+	p := pathKey(path)
 	
 	m.prepare()
 	
@@ -96,8 +96,8 @@ func (m *MemDir) PutTrack(path Path, keys []string, doc []byte) {
 		// We ran out of 32-bit indeces!
 		return
 	} else {
-		m.f[p] = i
 		i = uint32(len(m.s))
+		m.f[p] = i
 		m.s = append(m.s,keys)
 		m.p = append(m.p,path)
 		m.b = append(m.b,doc)
@@ -116,7 +116,7 @@ func (m *MemDir) PutTrack(path Path, keys []string, doc []byte) {
 func (m *MemDir) DelTrack(path Path) {
 	defer m.lock()()
 	
-	p := path[0]+"/"+path[1]+"/"+path[2]
+	p := pathKey(path)
 	
 	m.prepare()
 	
@@ -132,7 +132,7 @@ func (m *MemDir) DelAll(domain string) {
 	
 	m.prepare()
 	
-	pre := domain+"/"
+	pre := domain+"\x00"
 	l := len(pre)
 	
 	for p,i := range m.f {
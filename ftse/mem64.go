@@ -76,7 +76,7 @@ func (m *MemDir64) PutTrack(path Path, keys []string, doc []byte) {
 	defer m.lock()()
 	var i uint64
 	
-	p := path[0]+"/"+path[1]+"/"+path[2]
+	p := pathKey(path)
 	
 	m.prepare()
 	
@@ -94,8 +94,8 @@ func (m *MemDir64) PutTrack(path Path, keys []string, doc []byte) {
 		m.b[i] = doc
 		m.f[p] = i
 	} else {
-		m.f[p] = i
 		i = uint64(len(m.s))
+		m.f[p] = i
 		m.s = append(m.s,keys)
 		m.p = append(m.p,path)
 		m.b = append(m.b,doc)
@@ -114,7 +114,7 @@ func (m *MemDir64) PutTrack(path Path, keys []string, doc []byte) {
 func (m *MemDir64) DelTrack(path Path) {
 	defer m.lock()()
 	
-	p := path[0]+"/"+path[1]+"/"+path[2]
+	p := pathKey(path)
 	
 	m.prepare()
 	
@@ -130,7 +130,7 @@ func (m *MemDir64) DelAll(domain string) {
 	
 	m.prepare()
 	
-	pre := domain+"/"
+	pre := domain+"\x00"
 	l := len(pre)
 	
 	for p,i := range m.f {
@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package ftse
+
+import (
+	bson "github.com/mad-day/bsonbox/bsoncore"
+	"fmt"
+)
+
+var ENotAccepted = fmt.Errorf("ftse: publisher not accepted")
+var EMissingPath = fmt.Errorf("ftse: entry requires the fields \"_\" and \"f\"")
+var ETooManyFields = fmt.Errorf("ftse: too many fields")
+var ETooManyKeywords = fmt.Errorf("ftse: too many keywords")
+
+/*
+A Schema describes, which metadata documents are accepted by FTSI.Publish.
+
+Independent of the settings, an entry needs at least two fields, and all
+values must be strings. Beyond that, the zero value accepts everything.
+*/
+type Schema struct{
+	// Allowed field keys besides "_" and "f". A nil map allows every key.
+	Keys map[string]bool
+	
+	// Maximum length of a field value in bytes. Zero means unlimited.
+	MaxLength int
+	
+	// Maximum number of fields per entry, including "_" and "f". Zero means unlimited.
+	MaxFields int
+	
+	// Maximum number of keywords per entry. Zero means unlimited.
+	MaxKeywords int
+	
+	// If set, the first field must be "_" (the directory) and the second one "f" (the file name).
+	Required bool
+}
+
+// The schema used by FTSI, if FTSI.Schema is nil.
+var DefaultSchema = &Schema{
+	MaxLength: 1<<10,
+	MaxFields: 64,
+	MaxKeywords: 1<<9,
+	Required: true,
+}
+
+func (s *Schema) checkFields(elems []bson.Element) error {
+	if len(elems) < 2 { return EMissingPath }
+	if s.MaxFields>0 && len(elems)>s.MaxFields { return ETooManyFields }
+	for i,elem := range elems {
+		k := elem.Key()
+		switch {
+		case i==0 && s.Required:
+			if k!="_" { return EMissingPath }
+		case i==1 && s.Required:
+			if k!="f" { return EMissingPath }
+		case k=="_",k=="f":
+		case s.Keys!=nil && !s.Keys[k]:
+			return fmt.Errorf("ftse: field %q not allowed",k)
+		}
+		v,ok := elem.Value().StringValueOK()
+		if !ok { return fmt.Errorf("ftse: field %q is not a string",k) }
+		if s.MaxLength>0 && len(v)>s.MaxLength { return fmt.Errorf("ftse: field %q too long",k) }
+	}
+	return nil
+}
+
+func (s *Schema) checkKeywords(kwds []string) error {
+	if s.MaxKeywords>0 && len(kwds)>s.MaxKeywords { return ETooManyKeywords }
+	return nil
+}
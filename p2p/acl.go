@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+/*
+Optionally implemented by a FileSystem, that is restricted to certain directories.
+*/
+type DirFilter interface{
+	AllowDir(dir string) bool
+}
+
+/*
+Access control lists for the directories of a FileSystemEx. Directories
+without an entry are public. Everything else is only visible to the listed
+domains and to the members of the listed groups. Groups are written as
+"@name".
+
+As a FileSystem, ACL shows the public directories only. Use it as
+Server.FS, so every peer, that has logged in, gets its own view.
+*/
+type ACL struct{
+	FS     FileSystemEx
+	
+	m      sync.RWMutex
+	dirs   map[string][]string
+	groups map[string][]string
+}
+
+var _ FileSystemPeer = (*ACL)(nil)
+var _ FileSystemEx = (*ACL)(nil)
+
+// Restricts the directory to the given domains and groups. Without any, the directory becomes public.
+func (a *ACL) SetDir(dir string, who ...string) {
+	a.m.Lock(); defer a.m.Unlock()
+	if a.dirs==nil { a.dirs = make(map[string][]string) }
+	if len(who)==0 {
+		delete(a.dirs,dir)
+	} else {
+		a.dirs[dir] = append([]string(nil),who...)
+	}
+}
+
+// Sets the member domains of a group. The name is given without the "@".
+func (a *ACL) SetGroup(name string, domains ...string) {
+	a.m.Lock(); defer a.m.Unlock()
+	if a.groups==nil { a.groups = make(map[string][]string) }
+	if len(domains)==0 {
+		delete(a.groups,name)
+	} else {
+		a.groups[name] = append([]string(nil),domains...)
+	}
+}
+
+func (a *ACL) member(name, domain string) bool {
+	for _,d := range a.groups[name] {
+		if strings.EqualFold(d,domain) { return true }
+	}
+	return false
+}
+
+// Tells, whether the peer may access the directory. peer is nil for anonymous peers.
+func (a *ACL) Allowed(peer *Peer, dir string) bool {
+	a.m.RLock(); defer a.m.RUnlock()
+	who,ok := a.dirs[dir]
+	if !ok { return true }
+	if peer==nil { return false }
+	for _,w := range who {
+		if strings.HasPrefix(w,"@") {
+			if a.member(w[1:],peer.Domain) { return true }
+		} else if strings.EqualFold(w,peer.Domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ACL) ForPeer(peer *Peer) FileSystem {
+	v := aclView{a,peer}
+	if _,ok := a.FS.(FileSystemRA); ok { return aclViewRA{v} }
+	return v
+}
+
+func (a *ACL) LocalDir(dir string) (string,bool) {
+	fsl,ok := a.FS.(FileSystemLocal)
+	if !ok { return "",false }
+	return fsl.LocalDir(dir)
+}
+
+func (a *ACL) Open(p Path) (io.ReadCloser,error) { return aclView{a,nil}.Open(p) }
+func (a *ACL) Dirs() []string { return aclView{a,nil}.Dirs() }
+func (a *ACL) Files(dir string) ([]string,error) { return aclView{a,nil}.Files(dir) }
+
+// The part of the FileSystem, that is visible to a peer.
+type aclView struct{
+	acl  *ACL
+	peer *Peer
+}
+func (v aclView) AllowDir(dir string) bool { return v.acl.Allowed(v.peer,dir) }
+func (v aclView) Open(p Path) (io.ReadCloser,error) {
+	if !v.AllowDir(p[0]) { return nil,ENoDir }
+	return v.acl.FS.Open(p)
+}
+func (v aclView) Dirs() []string {
+	all := v.acl.FS.Dirs()
+	dirs := make([]string,0,len(all))
+	for _,d := range all {
+		if v.AllowDir(d) { dirs = append(dirs,d) }
+	}
+	return dirs
+}
+func (v aclView) Files(dir string) ([]string,error) {
+	if !v.AllowDir(dir) { return nil,ENoDir }
+	return v.acl.FS.Files(dir)
+}
+
+type aclViewRA struct{
+	aclView
+}
+func (v aclViewRA) OpenRA(p Path) (RandomFile,error) {
+	if !v.AllowDir(p[0]) { return nil,ENoDir }
+	return v.acl.FS.(FileSystemRA).OpenRA(p)
+}
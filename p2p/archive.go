@@ -0,0 +1,382 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var EArchiveType = errors.New("p2p: Unsupported archive type")
+
+/*
+Shares the members of zip and tar archives without extracting them. Each
+archive is a directory, named after its file. Archives with the same file
+name get a suffix like " (1)". Supported are ".zip", ".tar", ".tar.gz" and
+".tgz".
+
+Members, that are stored uncompressed, support random access. Compressed
+members are streamed, unless they are smaller than MaxBuffer. Those are
+decompressed into memory, so they are seekable as well. The decompressed
+members are cached, up to MaxCache bytes in total.
+*/
+type ArchiveFS struct{
+	Paths []string
+	
+	// Defaults to 16 MiB. A negative value disables buffering.
+	MaxBuffer int64
+	
+	// Defaults to 64 MiB.
+	MaxCache  int64
+	
+	m     sync.Mutex
+	cache map[string]*archiveIndex // Keyed by the path of the archive
+	bufs  []*archiveMember         // Members with cached data, oldest first
+	nbuf  int64
+}
+
+var _ FileSystemRA = (*ArchiveFS)(nil)
+var _ FileSystemEx = (*ArchiveFS)(nil)
+
+func (a *ArchiveFS) maxBuffer() int64 {
+	if a.MaxBuffer==0 { return 16<<20 }
+	return a.MaxBuffer
+}
+func (a *ArchiveFS) maxCache() int64 {
+	if a.MaxCache<=0 { return 64<<20 }
+	return a.MaxCache
+}
+
+type archiveKind int
+const (
+	kindZip archiveKind = iota
+	kindTar
+	kindTgz
+)
+
+func archiveKindOf(name string) (archiveKind,bool) {
+	n := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(n,".zip"): return kindZip,true
+	case strings.HasSuffix(n,".tar"): return kindTar,true
+	case strings.HasSuffix(n,".tar.gz"),strings.HasSuffix(n,".tgz"): return kindTgz,true
+	}
+	return 0,false
+}
+
+type archiveMember struct{
+	fi   os.FileInfo
+	zf   *zip.File // kindZip
+	off  int64     // kindTar: The offset of the data.
+	data []byte    // The decompressed data, if cached.
+}
+
+/*
+The index of an archive. It is rebuilt, once the archive changes. The old
+index is closed, once its last open member is closed.
+*/
+type archiveIndex struct{
+	refs    int  // Guarded by ArchiveFS.m
+	stale   bool // Guarded by ArchiveFS.m
+	path    string
+	kind    archiveKind
+	size    int64
+	mtime   time.Time
+	zr      *zip.ReadCloser
+	members map[string]*archiveMember
+	names   []string
+}
+
+// Counts the bytes read, so the offsets of tar members are known.
+type countReader struct{
+	r io.Reader
+	n int64
+}
+func (c *countReader) Read(b []byte) (int,error) {
+	n,err := c.r.Read(b)
+	c.n += int64(n)
+	return n,err
+}
+
+func (x *archiveIndex) add(name string, m *archiveMember) {
+	name,ok := CleanRelPath(name)
+	if !ok { return }
+	if _,dup := x.members[name]; dup { return }
+	x.members[name] = m
+	x.names = append(x.names,name)
+}
+
+func openArchive(path string, kind archiveKind, fi os.FileInfo) (*archiveIndex,error) {
+	x := &archiveIndex{path:path,kind:kind,size:fi.Size(),mtime:fi.ModTime(),members:make(map[string]*archiveMember)}
+	if kind==kindZip {
+		zr,err := zip.OpenReader(path)
+		if err!=nil { return nil,err }
+		x.zr = zr
+		for _,zf := range zr.File {
+			if !zf.Mode().IsRegular() { continue }
+			x.add(zf.Name,&archiveMember{fi:zf.FileInfo(),zf:zf})
+		}
+		return x,nil
+	}
+	f,err := os.Open(path)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	var r io.Reader = f
+	if kind==kindTgz {
+		gz,err := gzip.NewReader(f)
+		if err!=nil { return nil,err }
+		r = gz
+	}
+	cr := &countReader{r:r}
+	tr := tar.NewReader(cr)
+	for {
+		hdr,err := tr.Next()
+		if err==io.EOF { break }
+		if err!=nil { return nil,err }
+		if hdr.Typeflag!=tar.TypeReg && hdr.Typeflag!=tar.TypeRegA { continue }
+		// Right after Next, the reader stands at the data of the member.
+		x.add(hdr.Name,&archiveMember{fi:hdr.FileInfo(),off:cr.n})
+	}
+	return x,nil
+}
+
+func (x *archiveIndex) close() {
+	if x.zr!=nil { x.zr.Close() }
+}
+
+// Assigns a directory name to each archive. Returns the names and the archives by name.
+func (a *ArchiveFS) dirs() (names []string, paths map[string]string) {
+	paths = make(map[string]string,len(a.Paths))
+	for _,p := range a.Paths {
+		if _,ok := archiveKindOf(p); !ok { continue }
+		base := filepath.Base(p)
+		name := base
+		for i := 1 ; paths[name]!="" ; i++ { name = candidate(base,i) }
+		paths[name] = p
+		names = append(names,name)
+	}
+	return
+}
+
+// Returns the archive, that is shared as the directory dir.
+func (a *ArchiveFS) archive(dir string) (string,archiveKind,bool) {
+	_,paths := a.dirs()
+	p,ok := paths[dir]
+	if !ok { return "",0,false }
+	kind,_ := archiveKindOf(p)
+	return p,kind,true
+}
+
+// Returns the index of the archive. It must be released with a.release.
+func (a *ArchiveFS) index(dir string) (*archiveIndex,error) {
+	path,kind,ok := a.archive(dir)
+	if !ok { return nil,ENoDir }
+	fi,err := os.Stat(path)
+	if err!=nil { return nil,err }
+	a.m.Lock(); defer a.m.Unlock()
+	x := a.cache[path]
+	if x!=nil && x.size==fi.Size() && x.mtime.Equal(fi.ModTime()) {
+		x.refs++
+		return x,nil
+	}
+	if x!=nil {
+		// Files, that are still open, keep using the old index.
+		delete(a.cache,path)
+		x.stale = true
+		if x.refs==0 { x.close() }
+	}
+	x,err = openArchive(path,kind,fi)
+	if err!=nil { return nil,err }
+	if a.cache==nil { a.cache = make(map[string]*archiveIndex) }
+	a.cache[path] = x
+	x.refs++
+	return x,nil
+}
+
+func (a *ArchiveFS) release(x *archiveIndex) {
+	a.m.Lock(); defer a.m.Unlock()
+	x.refs--
+	if x.stale && x.refs==0 { x.close() }
+}
+
+// Wraps the closer of a member, so it releases the index once.
+func (a *ArchiveFS) closer(x *archiveIndex, c func() error) func() error {
+	var once sync.Once
+	return func() (err error) {
+		once.Do(func() {
+			err = c()
+			a.release(x)
+		})
+		return
+	}
+}
+
+/*
+Returns the decompressed data of a member. The data is cached, so a member is
+not decompressed again for each request.
+*/
+func (a *ArchiveFS) buffer(m *archiveMember) ([]byte,error) {
+	a.m.Lock()
+	data := m.data
+	a.m.Unlock()
+	if data!=nil { return data,nil }
+	r,err := m.zf.Open()
+	if err!=nil { return nil,err }
+	defer r.Close()
+	data,err = ioutil.ReadAll(r)
+	if err!=nil { return nil,err }
+	a.m.Lock(); defer a.m.Unlock()
+	if m.data!=nil { return m.data,nil }
+	m.data = data
+	a.bufs = append(a.bufs,m)
+	a.nbuf += int64(len(data))
+	for a.nbuf>a.maxCache() && len(a.bufs)>1 {
+		o := a.bufs[0]
+		a.bufs[0] = nil
+		a.bufs = a.bufs[1:]
+		a.nbuf -= int64(len(o.data))
+		o.data = nil
+	}
+	return data,nil
+}
+
+func (a *ArchiveFS) Dirs() []string {
+	names,_ := a.dirs()
+	return names
+}
+
+func (a *ArchiveFS) Files(dir string) ([]string,error) {
+	x,err := a.index(dir)
+	if err!=nil { return nil,err }
+	defer a.release(x)
+	return append([]string(nil),x.names...),nil
+}
+
+// A streamed archive member.
+type memberFile struct{
+	io.Reader
+	fi     os.FileInfo
+	closer func() error
+}
+func (f *memberFile) Close() error { return f.closer() }
+func (f *memberFile) Stat() (os.FileInfo,error) { return f.fi,nil }
+
+// An archive member with random access.
+type memberFileRA struct{
+	*io.SectionReader
+	fi     os.FileInfo
+	closer func() error
+}
+func (f *memberFileRA) Close() error { return f.closer() }
+func (f *memberFileRA) Stat() (os.FileInfo,error) { return f.fi,nil }
+
+func nop() error { return nil }
+
+func (a *ArchiveFS) Open(p Path) (io.ReadCloser,error) {
+	x,m,err := a.member(p)
+	if err!=nil { return nil,err }
+	f,err := a.open(x,m,p)
+	if err!=nil { a.release(x) }
+	return f,err
+}
+
+func (a *ArchiveFS) open(x *archiveIndex, m *archiveMember, p Path) (io.ReadCloser,error) {
+	if f,err := a.openRA(x,m); err!=ENotSeekable { return f,err }
+	switch x.kind {
+	case kindZip:
+		r,err := m.zf.Open()
+		if err!=nil { return nil,err }
+		return &memberFile{r,m.fi,a.closer(x,r.Close)},nil
+	case kindTgz:
+		f,err := openTgzMember(x.path,p[1],m.fi)
+		if err!=nil { return nil,err }
+		f.closer = a.closer(x,f.closer)
+		return f,nil
+	}
+	return nil,EArchiveType
+}
+
+func (a *ArchiveFS) OpenRA(p Path) (RandomFile,error) {
+	x,m,err := a.member(p)
+	if err!=nil { return nil,err }
+	f,err := a.openRA(x,m)
+	if err!=nil { a.release(x) }
+	return f,err
+}
+
+// Looks up a member. The index must be released with a.release.
+func (a *ArchiveFS) member(p Path) (*archiveIndex,*archiveMember,error) {
+	x,err := a.index(p[0])
+	if err!=nil { return nil,nil,err }
+	m,ok := x.members[p[1]]
+	if !ok { a.release(x); return nil,nil,ENoFile }
+	return x,m,nil
+}
+
+func (a *ArchiveFS) openRA(x *archiveIndex, m *archiveMember) (RandomFile,error) {
+	size := m.fi.Size()
+	switch {
+	case x.kind==kindTar:
+		f,err := os.Open(x.path)
+		if err!=nil { return nil,err }
+		return &memberFileRA{io.NewSectionReader(f,m.off,size),m.fi,a.closer(x,f.Close)},nil
+	case x.kind==kindZip && m.zf.Method==zip.Store:
+		off,err := m.zf.DataOffset()
+		if err!=nil { return nil,err }
+		f,err := os.Open(x.path)
+		if err!=nil { return nil,err }
+		return &memberFileRA{io.NewSectionReader(f,off,size),m.fi,a.closer(x,f.Close)},nil
+	case x.kind==kindZip && size<=a.maxBuffer():
+		data,err := a.buffer(m)
+		if err!=nil { return nil,err }
+		return &memberFileRA{io.NewSectionReader(bytes.NewReader(data),0,int64(len(data))),m.fi,a.closer(x,nop)},nil
+	}
+	return nil,ENotSeekable
+}
+
+// Streams a member of a compressed tar archive. The archive is read up to the member.
+func openTgzMember(path, name string, fi os.FileInfo) (*memberFile,error) {
+	f,err := os.Open(path)
+	if err!=nil { return nil,err }
+	gz,err := gzip.NewReader(f)
+	if err!=nil { f.Close(); return nil,err }
+	tr := tar.NewReader(gz)
+	for {
+		hdr,err := tr.Next()
+		if err==io.EOF { err = ENoFile }
+		if err!=nil { f.Close(); return nil,err }
+		if n,ok := CleanRelPath(hdr.Name); ok && n==name {
+			return &memberFile{tr,fi,f.Close},nil
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	bson "github.com/mad-day/bsonbox/bsoncore"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// The maximum number of entries per listing page.
+const MaxListing = 1<<10
+
+// An entry of a remote file listing.
+type FileEntry struct{
+	Name string
+	
+	// The metadata of the file, if requested and available.
+	Meta bson.Document
+}
+
+// Extracts the page [start,start+max) from the request. next is -1, if it is the last page.
+func paginate(req bson.Document, n int) (start, end, next int) {
+	max := MaxListing
+	if i,ok := req.Lookup("start").Int32OK(); ok && i>0 { start = int(i) }
+	if i,ok := req.Lookup("max").Int32OK(); ok && i>0 && int(i)<max { max = int(i) }
+	if start>n { start = n }
+	end,next = start+max,start+max
+	if end>=n { end,next = n,-1 }
+	return
+}
+
+func (c *connServer) listDirs(req bson.Document) bson.Document {
+	fse,ok := c.fs().(FileSystemEx)
+	if !ok { return pack("putdirs",404,"txt",ENoDir.Error()) }
+	dirs := fse.Dirs()
+	sort.Strings(dirs)
+	start,end,next := paginate(req,len(dirs))
+	db := bson.NewDocumentBuilder()
+	for i,d := range dirs[start:end] { db.AppendString(strconv.Itoa(start+i),d) }
+	return pack("putdirs",200,"next",next,"list",db.Build())
+}
+
+func (c *connServer) listFiles(dir string, req bson.Document) bson.Document {
+	fse,ok := c.fs().(FileSystemEx)
+	if !ok { return pack("putfiles",404,"txt",ENoDir.Error()) }
+	all,err := fse.Files(dir)
+	if err!=nil { return pack("putfiles",404,"txt",err.Error()) }
+	files := make([]string,0,len(all))
+	for _,f := range all {
+		if c.denied(Path{dir,f}) { continue }
+		files = append(files,f)
+	}
+	sort.Strings(files)
+	meta,_ := req.Lookup("meta").BooleanOK()
+	start,end,next := paginate(req,len(files))
+	db := bson.NewDocumentBuilder()
+	for i,f := range files[start:end] {
+		k := strconv.Itoa(start+i)
+		var doc bson.Document
+		if meta && c.Meta!=nil { doc,_ = c.Meta(c.fs(),Path{dir,f}) }
+		if doc==nil {
+			db.AppendString(k,f)
+		} else {
+			db.AppendDocument(k,doc)
+		}
+	}
+	return pack("putfiles",200,"next",next,"list",db.Build())
+}
+
+// Sends a listing request and returns the list and the start of the next page.
+func (c *Client) list(req bson.Document) (list []bson.Element, next int, dataerr, err error) {
+	defer c.lock()()
+	var msg bson.Document
+	var elems []bson.Element
+	err = c.write(req)
+	if err!=nil { return }
+	msg,err = c.readMessage()
+	if err!=nil { return }
+	defer c.pc.Free(msg)
+	
+	elems,err = msg.Elements()
+	if err!=nil { return }
+	
+	if len(elems)<2 { err = EProtocolError; return }
+	
+	code,_ := elems[0].Value().Int32OK()
+	if code!=200 {
+		s,_ := elems[1].Value().StringValueOK()
+		dataerr = fmt.Errorf("%v",s)
+		return
+	}
+	n,_ := msg.Lookup("next").Int32OK()
+	next = int(n)
+	doc,_ := msg.Lookup("list").DocumentOK()
+	list,err = doc.Elements()
+	for i := range list {
+		list[i] = append(bson.Element(nil),list[i]...)
+	}
+	return
+}
+
+func listReq(cmd, arg string, start, max int) []interface{} {
+	req := []interface{}{cmd,arg}
+	if start>0 { req = append(req,"start",start) }
+	if max>0 { req = append(req,"max",max) }
+	return req
+}
+
+/*
+Lists the shared directories of the peer, starting at the start-th entry.
+At most max entries are returned. If max is 0, the server decides.
+next is the start of the following page, or -1, if this is the last one.
+*/
+func (c *Client) ListDirs(start, max int) (dirs []string, next int, dataerr, err error) {
+	var list []bson.Element
+	list,next,dataerr,err = c.list(pack(listReq("listdirs","",start,max)...))
+	for _,elem := range list {
+		d,ok := elem.Value().StringValueOK()
+		if ok { dirs = append(dirs,d) }
+	}
+	return
+}
+
+/*
+Lists the files in a shared directory of the peer. Pagination works as in ListDirs.
+If meta is set, the metadata of the files is requested too.
+*/
+func (c *Client) ListFiles(dir string, start, max int, meta bool) (files []FileEntry, next int, dataerr, err error) {
+	var list []bson.Element
+	req := listReq("listfiles",dir,start,max)
+	if meta { req = append(req,"meta",true) }
+	list,next,dataerr,err = c.list(pack(req...))
+	for _,elem := range list {
+		if f,ok := elem.Value().StringValueOK(); ok {
+			files = append(files,FileEntry{Name:f})
+			continue
+		}
+		doc,ok := elem.Value().DocumentOK()
+		if !ok { continue }
+		f,_ := doc.Lookup("f").StringValueOK()
+		files = append(files,FileEntry{f,doc})
+	}
+	return
+}
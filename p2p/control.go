@@ -0,0 +1,153 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	bson "github.com/mad-day/bsonbox/bsoncore"
+	"errors"
+	"sync/atomic"
+)
+
+var ECancelled = errors.New("p2p: Transfer cancelled")
+
+/*
+The state of a transfer, that is shared between the request handler and the
+filewriter. It is kept, while the transfer waits for a slot, too.
+*/
+type xstate struct{
+	paused    int32
+	cancelled int32
+}
+
+func (x *xstate) isPaused() bool { return atomic.LoadInt32(&x.paused)!=0 }
+func (x *xstate) isCancelled() bool { return atomic.LoadInt32(&x.cancelled)!=0 }
+
+// Tells, whether the transfer can send its next frame.
+func (q *queueElement) runnable() bool {
+	return !q.st.isPaused() && (q.started || len(q.sum)>0)
+}
+
+func hasRunning(active []*queueElement) bool {
+	for _,felem := range active {
+		if felem.runnable() { return true }
+	}
+	return false
+}
+
+// Wakes up the filewriter.
+func (c *connServer) poke() {
+	select {
+	case c.wake <- 1:
+	default:
+	}
+}
+
+// Applies a cancel, pause or resume command. Commands for unknown transfers are ignored.
+func (c *connServer) control(op string, id int32) {
+	v,ok := c.live.Load(id)
+	if !ok { return }
+	st := v.(*xstate)
+	switch op {
+	case "pause": atomic.StoreInt32(&st.paused,1)
+	case "resume": atomic.StoreInt32(&st.paused,0)
+	case "cancel":
+		atomic.StoreInt32(&st.cancelled,1)
+		if c.Slots!=nil && c.Slots.remove(c,id) {
+			c.sendlo(pack("dl.end",0,"id",id,"err",ECancelled.Error()))
+			return
+		}
+	}
+	c.poke()
+}
+
+/*
+Ends a transfer. The end of a cancelled transfer is sent to the client, after
+the frames, that are still queued, so the writer can drop them.
+*/
+func (c *connServer) ended(felem *queueElement) {
+	felem.close()
+	if felem.st.isCancelled() {
+		c.sendlo(pack("dl.end",0,"id",felem.id,"err",ECancelled.Error()))
+	} else {
+		c.live.Delete(felem.id)
+	}
+}
+
+// Tells, whether the frame belongs to a cancelled transfer. Its final "dl.end" passes.
+func (c *connServer) isDropped(msg bson.Document) bool {
+	id,ok := msg.Lookup("id").Int32OK()
+	if !ok { return false }
+	v,ok := c.live.Load(id)
+	if !ok || !v.(*xstate).isCancelled() { return false }
+	elem,_ := msg.IndexErr(0)
+	if string(elem.KeyBytes())!="dl.end" { return true }
+	c.live.Delete(id)
+	return false
+}
+
+// Sends a command for a transfer. There is no response, so it does not wait for other requests.
+func (c *Client) command(op string, id int32) error {
+	return c.write(pack(op,id))
+}
+
+/*
+Cancels a transfer. The server stops sending it and the target is aborted.
+*/
+func (c *Client) Cancel(id int32) error {
+	err := c.command("cancel",id)
+	
+	// Tell the receiving goroutine to abort the target and to ignore the rest of the transfer.
+	select {
+	case c.cancel <- id:
+	case <- c.alive:
+	}
+	return err
+}
+
+// Cancels all transfers of the given file.
+func (c *Client) CancelPath(p Path) error { return c.forPath(p,c.Cancel) }
+
+// Pauses all transfers of the given file.
+func (c *Client) PausePath(p Path) error { return c.forPath(p,c.Pause) }
+
+// Continues all paused transfers of the given file.
+func (c *Client) UnpausePath(p Path) error { return c.forPath(p,c.Unpause) }
+
+// Pauses a transfer. The server keeps the file open, until it is resumed or cancelled.
+func (c *Client) Pause(id int32) error { return c.command("pause",id) }
+
+// Continues a paused transfer.
+func (c *Client) Unpause(id int32) error { return c.command("resume",id) }
+
+func (c *Client) forPath(p Path, f func(id int32) error) (err error) {
+	var ids []int32
+	c.xfers.Range(func(k, v interface{}) bool {
+		if v.(Path)==p { ids = append(ids,k.(int32)) }
+		return true
+	})
+	if len(ids)==0 { return ENoFile }
+	for _,id := range ids {
+		if e := f(id); err==nil { err = e }
+	}
+	return
+}
@@ -30,13 +30,40 @@ import (
 	"strings"
 )
 
-func BadFileName(s string) bool {
-	for _,b := range []byte(s) {
-		if b==filepath.Separator { return true }
-		if b=='\\' || b=='/' { return true }
+/*
+Normalizes a relative file path within a shared directory. Separators become
+"/", empty and "." segments are removed. ok is false, if the path is empty,
+absolute or escapes the directory with "..".
+*/
+func CleanRelPath(s string) (c string, ok bool) {
+	s = strings.Replace(s,"\\","/",-1)
+	if strings.HasPrefix(s,"/") || filepath.VolumeName(filepath.FromSlash(s))!="" { return }
+	segs := strings.Split(s,"/")
+	out := segs[:0]
+	for _,seg := range segs {
+		switch seg {
+		case "",".": continue
+		case "..": return
+		}
+		for _,r := range seg {
+			if r<' ' { return }
+		}
+		out = append(out,seg)
 	}
-	if s=="." { return true }
-	return false
+	if len(out)==0 { return }
+	return strings.Join(out,"/"),true
+}
+
+// Tells, whether s is not a normalized relative path (see CleanRelPath).
+func BadFileName(s string) bool {
+	c,ok := CleanRelPath(s)
+	return !ok || c!=s
+}
+
+// Normalizes the file part of a requested path. Invalid paths are left as they are.
+func normPath(p Path) Path {
+	if c,ok := CleanRelPath(p[1]); ok { p[1] = c }
+	return p
 }
 
 func cleanup(r rune) rune {
@@ -49,12 +76,51 @@ func CleanUpFile(s string) string {
 	return strings.Map(cleanup,s)
 }
 
+// Like os.Open, but returns a nil interface on error. Directories are refused.
+func osOpen(name string) (RandomFile,error) {
+	f,err := os.Open(name)
+	if err!=nil { return nil,err }
+	fi,err := f.Stat()
+	if err==nil && fi.IsDir() { err = ENoFile }
+	if err!=nil { f.Close(); return nil,err }
+	return f,nil
+}
+
+// Lists the files below root, including subdirectories. The paths are relative and use "/".
+func walkFiles(root string) (files []string, err error) {
+	err = filepath.Walk(root,func(p string, fi os.FileInfo, err error) error {
+		if err!=nil {
+			if p==root { return err }
+			return nil // Skip, what can't be read.
+		}
+		if fi.Mode()&os.ModeSymlink!=0 {
+			fi,err = os.Stat(p)
+			if err!=nil { return nil }
+		}
+		if !fi.Mode().IsRegular() { return nil }
+		rel,err := filepath.Rel(root,p)
+		if err!=nil { return nil }
+		rel = filepath.ToSlash(rel)
+		if BadFileName(rel) { return nil }
+		files = append(files,rel)
+		return nil
+	})
+	return
+}
+
 type Dir string
 func (d Dir) Open(p Path) (io.ReadCloser,error) {
+	return d.OpenRA(p)
+}
+func (d Dir) OpenRA(p Path) (RandomFile,error) {
 	if BadFileName(p[1]) { return nil,ENoFile }
 	_,f := filepath.Split(string(d))
 	if p[0]!=f { return nil,ENoDir }
-	return os.Open(filepath.Join(string(d),p[1]))
+	return osOpen(filepath.Join(string(d),filepath.FromSlash(p[1])))
+}
+func (d Dir) LocalDir(dir string) (string,bool) {
+	_,f := filepath.Split(string(d))
+	return string(d),dir==f
 }
 func (d Dir) Dirs() []string {
 	_,f := filepath.Split(string(d))
@@ -63,20 +129,27 @@ func (d Dir) Dirs() []string {
 func (d Dir) Files(dir string) ([]string,error) {
 	_,f := filepath.Split(string(d))
 	if dir!=f { return nil,ENoDir }
-	g,err := os.Open(string(d))
-	if err!=nil { return nil,err }
-	defer g.Close()
-	return g.Readdirnames(-1)
+	return walkFiles(string(d))
 }
 
 type DirColl []Dir
-func (d DirColl) Open(p Path) (r io.ReadCloser,e error) {
+func (d DirColl) Open(p Path) (io.ReadCloser,error) {
+	return d.OpenRA(p)
+}
+func (d DirColl) OpenRA(p Path) (r RandomFile,e error) {
+	e = ENoDir
 	for _,dd := range d {
-		r,e = dd.Open(p)
+		r,e = dd.OpenRA(p)
 		if e!=ENoDir { break }
 	}
 	return
 }
+func (d DirColl) LocalDir(dir string) (string,bool) {
+	for _,dd := range d {
+		if l,ok := dd.LocalDir(dir); ok { return l,true }
+	}
+	return "",false
+}
 func (d DirColl) Dirs() []string {
 	s := make([]string,len(d))
 	for i,dd := range d {
@@ -94,11 +167,18 @@ func (d DirColl) Files(dir string) (r []string,e error) {
 }
 
 type DirMap map[string]string
-func (d DirMap) Open(p Path) (r io.ReadCloser,e error) {
+func (d DirMap) Open(p Path) (io.ReadCloser,error) {
+	return d.OpenRA(p)
+}
+func (d DirMap) OpenRA(p Path) (RandomFile,error) {
 	if BadFileName(p[1]) { return nil,ENoFile }
 	f,ok := d[p[0]]
-	if ok { return nil,ENoDir }
-	return os.Open(filepath.Join(f,p[1]))
+	if !ok { return nil,ENoDir }
+	return osOpen(filepath.Join(f,filepath.FromSlash(p[1])))
+}
+func (d DirMap) LocalDir(dir string) (string,bool) {
+	f,ok := d[dir]
+	return f,ok
 }
 func (d DirMap) Dirs() (z []string) {
 	z = make([]string,0,len(d))
@@ -107,15 +187,38 @@ func (d DirMap) Dirs() (z []string) {
 }
 func (d DirMap) Files(dir string) (r []string,e error) {
 	f,ok := d[dir]
-	if ok { return nil,ENoDir }
-	g,err := os.Open(f)
-	if err!=nil { return nil,err }
-	defer g.Close()
-	return g.Readdirnames(-1)
+	if !ok { return nil,ENoDir }
+	return walkFiles(f)
 }
 
 type dfToken int
 
+var _ FileSystemRA = Dir("")
+var _ FileSystemRA = DirColl(nil)
+var _ FileSystemRA = DirMap(nil)
+var _ FileSystemLocal = DirColl(nil)
+var _ TargetStoreEx = (*DownloadFolder)(nil)
+var _ TargetWriter = (*dlFile)(nil)
+
+/*
+Aborts a download into a local file. If it failed the integrity check, everything
+written since off is discarded. Otherwise, the data, that has been received, is
+kept, so an interrupted download can be resumed.
+*/
+func abortFile(f *os.File, off int64, err error) error {
+	cerr := f.Close()
+	if err!=EIntegrity { return cerr }
+	if off==0 { return os.Remove(f.Name()) }
+	return os.Truncate(f.Name(),off)
+}
+
+// A file in a DownloadFolder. See abortFile for what Abort keeps.
+type dlFile struct{
+	*os.File
+	off int64
+}
+func (f *dlFile) Abort(err error) error { return abortFile(f.File,f.off,err) }
+
 type DownloadFolder struct{
 	Dir string
 	
@@ -126,7 +229,27 @@ func (df *DownloadFolder) Create(t Token, p Path) (io.WriteCloser,error) {
 	if t==nil { return nil,EDlRejected }
 	B := CleanUpFile(p[1])
 	C := filepath.Join(df.Dir,B)
-	return os.Create(C)
+	f,err := os.Create(C)
+	if err!=nil { return nil,err }
+	return &dlFile{f,0},nil
+}
+func (df *DownloadFolder) Open(t Token, p Path, off int64) (io.WriteCloser,error) {
+	if t==nil { return nil,EDlRejected }
+	B := CleanUpFile(p[1])
+	C := filepath.Join(df.Dir,B)
+	f,err := os.OpenFile(C,os.O_WRONLY|os.O_CREATE,0666)
+	if err!=nil { return nil,err }
+	_,err = f.Seek(off,io.SeekStart)
+	if err!=nil { f.Close(); return nil,err }
+	return &dlFile{f,off},nil
+}
+func (df *DownloadFolder) Partial(t Token, p Path) (int64,error) {
+	B := CleanUpFile(p[1])
+	C := filepath.Join(df.Dir,B)
+	fi,err := os.Stat(C)
+	if os.IsNotExist(err) { return 0,nil }
+	if err!=nil { return 0,err }
+	return fi.Size(),nil
 }
 
 
@@ -0,0 +1,199 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	bson "github.com/mad-day/bsonbox/bsoncore"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+)
+
+var EIntegrity = errors.New("p2p: Integrity Check failed")
+var ETruncated = errors.New("p2p: Transfer truncated")
+
+/*
+Optionally implemented by the writers returned from a TargetStore.
+Close commits a completed transfer. Abort is called instead, if the transfer
+failed or did not pass the integrity check. It should discard or quarantine
+the written data.
+*/
+type TargetWriter interface{
+	io.WriteCloser
+	Abort(err error) error
+}
+
+// Aborts the target, if it supports it, or closes it otherwise.
+func abortTarget(w io.WriteCloser, err error) {
+	if tw,ok := w.(TargetWriter); ok {
+		tw.Abort(err)
+	} else {
+		w.Close()
+	}
+}
+
+// The checksum of a byte range.
+type rangeSum struct{
+	sum  []byte
+	size int64
+	err  error
+}
+
+// Computes the SHA-256 sum and the length of a byte range of a file.
+func hashRange(fs FileSystem, p Path, off, n int64) (sum []byte, size int64, err error) {
+	f,err := OpenRange(fs,p,off,n)
+	if err!=nil { return }
+	defer f.Close()
+	h := sha256.New()
+	size,err = io.Copy(h,f)
+	sum = h.Sum(make([]byte,0,32))
+	return
+}
+
+/*
+-------------------------------------------------------------------------------
+*                               Transfer Events
+-------------------------------------------------------------------------------
+*/
+
+// The minimum number of bytes between two Progress events of a transfer.
+var ProgressStep int64 = 1<<18
+
+type EventKind int
+const (
+	// The transfer has started.
+	EvStart EventKind = iota
+	
+	// Data has been received.
+	EvProgress
+	
+	// The transfer has ended. Event.Err tells, whether it was successful.
+	EvDone
+	
+	// The transfer waits for an upload slot. Event.Queue is the position in the queue.
+	EvQueued
+)
+
+// Describes the state of a transfer.
+type Event struct{
+	Kind  EventKind
+	Token Token
+	Path  Path
+	
+	// The transfer ID. It can be passed to Client.Cancel, Pause and Unpause.
+	ID    int32
+	
+	// The offset of the transfer within the file.
+	Off   int64
+	
+	// The number of bytes received so far.
+	Received int64
+	
+	// The number of bytes of the transfer or -1, if unknown.
+	Total int64
+	
+	// Why the transfer failed. Only set for EvDone.
+	Err   error
+	
+	// The position in the server's upload queue. Only set for EvQueued.
+	Queue int
+}
+
+// Optionally implemented by a Token, that wants to observe its own transfer.
+type TokenObserver interface{
+	Transfer(ev Event)
+}
+
+// Optionally implemented by a TargetStore, that wants to know, how a transfer ended.
+type TargetStoreDone interface{
+	Done(t Token, p Path, err error)
+}
+
+func (cc *ClientContext) emit(ev Event) {
+	if to,ok := ev.Token.(TokenObserver); ok { to.Transfer(ev) }
+	if cc.OnEvent!=nil { cc.OnEvent(ev) }
+	if ev.Kind!=EvDone { return }
+	if td,ok := cc.Target.(TargetStoreDone); ok { td.Done(ev.Token,ev.Path,ev.Err) }
+}
+
+/*
+-------------------------------------------------------------------------------
+*                                   Download
+-------------------------------------------------------------------------------
+*/
+
+// A transfer, received by the client.
+type download struct{
+	cc   *ClientContext
+	id   int32
+	tok  Token
+	path Path
+	off  int64
+	w    io.WriteCloser
+	h    hash.Hash
+	sum  []byte
+	size int64
+	got  int64
+	last int64
+	err  error
+}
+
+func newDownload(cc *ClientContext, id int32, tok Token, path Path, off int64, w io.WriteCloser, hdr bson.Document) *download {
+	d := &download{cc:cc,id:id,tok:tok,path:path,off:off,w:w,h:sha256.New(),size:-1}
+	_,sum,ok := hdr.Lookup("sha2").BinaryOK()
+	if ok { d.sum = append([]byte(nil),sum...) }
+	if i,ok := hdr.Lookup("size").Int64OK(); ok { d.size = i }
+	d.emit(EvStart,nil)
+	return d
+}
+
+func (d *download) emit(kind EventKind, err error) {
+	d.cc.emit(Event{Kind:kind,Token:d.tok,Path:d.path,ID:d.id,Off:d.off,Received:d.got,Total:d.size,Err:err})
+}
+
+func (d *download) write(data []byte) {
+	if d.err!=nil { return }
+	_,d.err = d.w.Write(data)
+	d.h.Write(data)
+	d.got += int64(len(data))
+	if d.got-d.last < ProgressStep { return }
+	d.last = d.got
+	d.emit(EvProgress,nil)
+}
+
+// Finishes the transfer. The target is committed, if the transfer passed the integrity checks.
+func (d *download) finish(serr error) (err error) {
+	defer func(){ d.emit(EvDone,err) }()
+	err = d.err
+	if err==nil { err = serr }
+	if err==nil && d.size>=0 && d.got!=d.size { err = ETruncated }
+	if err==nil && d.sum!=nil && !bytes.Equal(d.h.Sum(nil),d.sum) { err = EIntegrity }
+	if err!=nil {
+		abortTarget(d.w,err)
+		return
+	}
+	err = d.w.Close()
+	return
+}
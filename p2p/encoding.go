@@ -38,6 +38,7 @@ func pack(i ...interface{}) bson.Document {
 		case int32: db.AppendInt32(k,e)
 		case int64: db.AppendInt64(k,e)
 		case int:  db.AppendInt32(k,int32(e))
+		case bool: db.AppendBoolean(k,e)
 		case bson.Document: db.AppendDocument(k,e)
 		}
 		i = i[2:]
@@ -25,6 +25,7 @@ package p2p
 
 import (
 	"io"
+	"io/ioutil"
 	"sync"
 	"errors"
 )
@@ -33,20 +34,58 @@ var ENoDir = errors.New("p2p: Dir not Found")
 var ENoFile = errors.New("p2p: File not Found")
 var EDlRejected = errors.New("p2p: Download Rejected")
 
+// Returned by FileSystemRA.OpenRA, if the file must be read sequentially with Open.
+var ENotSeekable = errors.New("p2p: File not seekable")
+
 type Path [2]string
 
 type FileSystem interface{
 	Open(p Path) (io.ReadCloser,error)
 }
+// A file, that supports random access.
+type RandomFile interface{
+	io.ReadCloser
+	io.Seeker
+	io.ReaderAt
+}
+
+// Optionally implemented by a FileSystem, whose files support random access.
+type FileSystemRA interface{
+	FileSystem
+	OpenRA(p Path) (RandomFile,error)
+}
+
 type FileSystemEx interface{
 	FileSystem
 	Dirs() []string
 	Files(dir string) ([]string,error)
 }
 
+// Optionally implemented by a FileSystemEx, whose directories are directories of the local file system.
+type FileSystemLocal interface{
+	// Returns the local directory of the shared directory dir.
+	LocalDir(dir string) (string,bool)
+}
+
 type queueElement struct {
 	fobj io.ReadCloser
 	path Path
+	off  int64
+	n    int64
+	id   int32
+	started bool
+	st      *xstate
+	
+	// The checksum of the transfer, computed in the background.
+	sum  chan rangeSum
+	
+	// Frees the upload slot, if any.
+	release func()
+}
+
+func (q *queueElement) close() {
+	if q.fobj!=nil { q.fobj.Close() }
+	if q.release!=nil { q.release() }
 }
 
 type fileQueue chan queueElement
@@ -54,10 +93,59 @@ type fileQueue chan queueElement
 type Token interface{
 }
 
+/*
+Optionally implemented by a Token. If so, the data is written into the target,
+the token provides, instead of the TargetStore.
+*/
+type TokenTarget interface{
+	Open(p Path, off int64) (io.WriteCloser,error)
+}
+
 type TargetStore interface{
 	Create(t Token, p Path) (io.WriteCloser,error)
 }
 
+// Optionally implemented by a TargetStore, that can continue partial downloads.
+type TargetStoreEx interface{
+	TargetStore
+	
+	// Opens the target for writing at the given offset, without truncating it.
+	Open(t Token, p Path, off int64) (io.WriteCloser,error)
+	
+	// Returns the number of bytes, that have already been written to the target.
+	Partial(t Token, p Path) (int64,error)
+}
+
+type rangeReader struct{
+	io.Reader
+	io.Closer
+}
+
+/*
+Opens the byte range [off,off+n) of a file. If n is negative, the range extends
+to the end of the file.
+*/
+func OpenRange(fs FileSystem, p Path, off, n int64) (io.ReadCloser,error) {
+	if n<0 { n = 1<<62 }
+	if fra,ok := fs.(FileSystemRA); ok {
+		f,err := fra.OpenRA(p)
+		if err==nil { return rangeReader{io.NewSectionReader(f,off,n),f},nil }
+		if err!=ENotSeekable { return nil,err }
+	}
+	f,err := fs.Open(p)
+	if err!=nil { return nil,err }
+	if off>0 {
+		if sk,ok := f.(io.Seeker); ok {
+			_,err = sk.Seek(off,io.SeekStart)
+		} else {
+			_,err = io.CopyN(ioutil.Discard,f,off)
+			if err==io.EOF { err = nil }
+		}
+		if err!=nil { f.Close(); return nil,err }
+	}
+	return rangeReader{io.LimitReader(f,n),f},nil
+}
+
 type PathTokenMap struct{
 	s sync.RWMutex
 	m map[Path]Token
@@ -76,3 +164,26 @@ func (m *PathTokenMap) Put(p Path,t Token) {
 	}
 }
 
+// Maps transfer IDs to tokens.
+type idTokenMap struct{
+	s sync.Mutex
+	m map[int32]Token
+}
+func (m *idTokenMap) Put(id int32,t Token) {
+	m.s.Lock(); defer m.s.Unlock()
+	if m.m==nil { m.m = make(map[int32]Token) }
+	m.m[id] = t
+}
+
+func (m *idTokenMap) Get(id int32) (t Token) {
+	m.s.Lock(); defer m.s.Unlock()
+	return m.m[id]
+}
+
+// Returns the token and removes it from the map.
+func (m *idTokenMap) Take(id int32) (t Token) {
+	m.s.Lock(); defer m.s.Unlock()
+	t = m.m[id]
+	delete(m.m,id)
+	return
+}
@@ -0,0 +1,196 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The size of the pieces, a file is split into for hashing.
+const PieceSize = 1<<20
+
+/*
+The content hash of a file. The file is split into pieces of PieceSize bytes,
+each piece is hashed with SHA-256 and the Root is the SHA-256 sum over the
+concatenated piece hashes.
+*/
+type FileHash struct{
+	Root   []byte
+	Size   int64
+	Pieces [][]byte
+}
+
+func (h *FileHash) Hex() string { return hex.EncodeToString(h.Root) }
+
+// Checks, that the piece hashes match the root hash and the size.
+func (h *FileHash) Verify() bool {
+	n := (h.Size+PieceSize-1)/PieceSize
+	if int64(len(h.Pieces))!=n { return false }
+	return bytes.Equal(rootHash(h.Pieces),h.Root)
+}
+
+// Returns the byte range of the i-th piece.
+func (h *FileHash) PieceRange(i int) (off, n int64) {
+	off = int64(i)*PieceSize
+	n = h.Size-off
+	if n>PieceSize { n = PieceSize }
+	return
+}
+
+func rootHash(pieces [][]byte) []byte {
+	r := sha256.New()
+	for _,p := range pieces { r.Write(p) }
+	return r.Sum(make([]byte,0,32))
+}
+
+func (h *FileHash) concat() []byte {
+	b := make([]byte,0,len(h.Pieces)*sha256.Size)
+	for _,p := range h.Pieces { b = append(b,p...) }
+	return b
+}
+func splitPieces(b []byte) (p [][]byte) {
+	for len(b)>=sha256.Size {
+		p = append(p,b[:sha256.Size])
+		b = b[sha256.Size:]
+	}
+	return
+}
+
+func hashReader(r io.Reader) (*FileHash,error) {
+	h := new(FileHash)
+	buf := make([]byte,PieceSize)
+	for {
+		n,err := io.ReadFull(r,buf)
+		if n>0 {
+			s := sha256.Sum256(buf[:n])
+			h.Pieces = append(h.Pieces,s[:])
+			h.Size += int64(n)
+		}
+		if err==io.EOF || err==io.ErrUnexpectedEOF { break }
+		if err!=nil { return nil,err }
+	}
+	h.Root = rootHash(h.Pieces)
+	return h,nil
+}
+
+// Computes the content hash of a file.
+func HashFile(fs FileSystem, p Path) (*FileHash,error) {
+	f,err := fs.Open(p)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	return hashReader(f)
+}
+
+type hcEntry struct{
+	size  int64
+	mtime time.Time
+	hash  *FileHash
+	
+	// The SHA-256 sum and the length of a byte range.
+	sum   []byte
+	n     int64
+}
+
+// The cache key of the SHA-256 sum of a byte range.
+type hcRange struct{
+	p      Path
+	off, n int64
+}
+
+/*
+Caches content hashes of files. An entry is reused, as long as the size and the
+modification time of the file stay the same. Files, that can not tell their
+size and modification time (they don't have a Stat method), are hashed every time.
+*/
+type HashCache struct{
+	// The number of entries, after which the older half is dropped. Defaults to 4096.
+	MaxEntries int
+	
+	m sync.Mutex
+	e [2]map[interface{}]hcEntry
+	c uint
+}
+
+func (hc *HashCache) maxEntries() int {
+	if hc.MaxEntries<=0 { return 4096 }
+	return hc.MaxEntries
+}
+
+func (hc *HashCache) get(key interface{}) (e hcEntry, ok bool) {
+	hc.m.Lock(); defer hc.m.Unlock()
+	e,ok = hc.e[hc.c][key]
+	if !ok { e,ok = hc.e[hc.c^1][key] }
+	return
+}
+
+func (hc *HashCache) put(key interface{}, e hcEntry) {
+	hc.m.Lock(); defer hc.m.Unlock()
+	cur := hc.e[hc.c]
+	if cur==nil { cur = make(map[interface{}]hcEntry); hc.e[hc.c] = cur }
+	cur[key] = e
+	if len(cur) >= hc.maxEntries() {
+		hc.c ^= 1
+		hc.e[hc.c] = nil
+	}
+}
+
+// Looks up the entry of a file. On a miss, it is computed from the opened file.
+func (hc *HashCache) lookup(fs FileSystem, p Path, key interface{}, compute func(f io.Reader) (hcEntry,error)) (e hcEntry, err error) {
+	f,err := fs.Open(p)
+	if err!=nil { return }
+	defer f.Close()
+	st,ok := f.(interface{ Stat() (os.FileInfo,error) })
+	if hc==nil || !ok { return compute(f) }
+	fi,err := st.Stat()
+	if err!=nil { return }
+	e,ok = hc.get(key)
+	if ok && e.size==fi.Size() && e.mtime.Equal(fi.ModTime()) { return }
+	e,err = compute(f)
+	if err!=nil { return }
+	e.size,e.mtime = fi.Size(),fi.ModTime()
+	hc.put(key,e)
+	return
+}
+
+func (hc *HashCache) Get(fs FileSystem, p Path) (*FileHash,error) {
+	e,err := hc.lookup(fs,p,p,func(f io.Reader) (e hcEntry, err error) {
+		e.hash,err = hashReader(f)
+		return
+	})
+	return e.hash,err
+}
+
+// Computes the SHA-256 sum and the length of a byte range of a file.
+func (hc *HashCache) Range(fs FileSystem, p Path, off, n int64) (sum []byte, size int64, err error) {
+	e,err := hc.lookup(fs,p,hcRange{p,off,n},func(io.Reader) (e hcEntry, err error) {
+		e.sum,e.n,err = hashRange(fs,p,off,n)
+		return
+	})
+	return e.sum,e.n,err
+}
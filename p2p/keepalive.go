@@ -0,0 +1,90 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Tracks the activity of a connection.
+type keepalive struct{
+	recv int64 // Last frame received (UnixNano)
+	used int64 // Last request or transfer (UnixNano)
+	rtt  int64
+}
+
+func (k *keepalive) touch(use bool) {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&k.recv,now)
+	if use { atomic.StoreInt64(&k.used,now) }
+}
+
+func (k *keepalive) pong(ts int64) {
+	d := time.Now().UnixNano()-ts
+	if d>=0 { atomic.StoreInt64(&k.rtt,d) }
+}
+
+func (k *keepalive) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&k.rtt))
+}
+
+/*
+Probes the connection every interval, unless frames were received meanwhile.
+If there was no answer for three intervals, the connection is considered
+dead and closed. If idle is set, an unused connection is closed as well.
+*/
+func (k *keepalive) run(alive signal, every, idle time.Duration, ping func(ts int64), close func()) {
+	if every==0 { every = time.Minute }
+	if every<0 && idle<=0 { return }
+	tick := every
+	if every<0 || (idle>0 && idle<tick) { tick = idle }
+	k.touch(true)
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case <- alive: return
+		case <- t.C:
+		}
+		now := time.Now().UnixNano()
+		if idle>0 && now-atomic.LoadInt64(&k.used) >= int64(idle) { close(); return }
+		if every<0 { continue }
+		silent := now-atomic.LoadInt64(&k.recv)
+		if silent >= 3*int64(every) { close(); return }
+		if silent >= int64(every) { ping(now) }
+	}
+}
+
+// Never blocks. If the connection is stuck, the ping is lost, but that is detected anyway.
+func (c *connServer) ping(ts int64) {
+	select {
+	case c.outhi <- pack("ping",ts):
+	default:
+	}
+}
+
+func (c *Client) ping(ts int64) { go c.write(pack("ping",ts)) }
+
+// Returns the round-trip time, measured by the last ping. It is 0, if unknown.
+func (c *Client) RTT() time.Duration { return c.ka.RTT() }
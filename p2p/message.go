@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	bson "github.com/mad-day/bsonbox/bsoncore"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ENoInbox = errors.New("p2p: Messages not accepted")
+
+// The maximum length of a message text in bytes.
+var MaxMessage = 1<<14
+
+// An instant message between two peers.
+type Message struct{
+	ID   string
+	From string
+	Time time.Time
+	Text string
+	
+	// True, if From is the domain of the peer, that has logged in.
+	Verified bool
+}
+
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func (c *connServer) message(msg bson.Document) bson.Document {
+	var m Message
+	m.Text,_ = msg.Lookup("msg").StringValueOK()
+	m.From,_ = msg.Lookup("from").StringValueOK()
+	m.ID,_ = msg.Lookup("mid").StringValueOK()
+	ts,_ := msg.Lookup("ts").Int64OK()
+	m.Time = time.Unix(0,ts*int64(time.Millisecond))
+	if c.Inbox==nil { return pack("msgack",501,"txt",ENoInbox.Error(),"mid",m.ID) }
+	if len(m.Text)>MaxMessage { return pack("msgack",413,"txt","message too long","mid",m.ID) }
+	if p := c.peer(); p!=nil {
+		m.From,m.Verified = p.Domain,true
+	}
+	if err := c.Inbox(&m); err!=nil {
+		return pack("msgack",403,"txt",err.Error(),"mid",m.ID)
+	}
+	return pack("msgack",200,"mid",m.ID)
+}
+
+/*
+Sends a message to the peer and waits for the acknowledgement. from is the
+domain of the sender. If the client has logged in, the server uses the login
+domain instead. dataerr is set, if the peer did not accept the message.
+*/
+func (c *Client) SendMessage(from, text string) (m *Message, dataerr, err error) {
+	defer c.lock()()
+	var msg bson.Document
+	var elems []bson.Element
+	m = &Message{ID:newMessageID(),From:from,Time:time.Now(),Text:text}
+	ts := m.Time.UnixNano()/int64(time.Millisecond)
+	err = c.write(pack("msg",text,"from",from,"ts",ts,"mid",m.ID))
+	if err!=nil { return }
+	msg,err = c.readMessage()
+	if err!=nil { return }
+	defer c.pc.Free(msg)
+	
+	elems,err = msg.Elements()
+	if err!=nil { return }
+	
+	if len(elems)<2 { err = EProtocolError; return }
+	
+	if mid,_ := msg.Lookup("mid").StringValueOK(); mid!=m.ID { err = EProtocolError; return }
+	code,_ := elems[0].Value().Int32OK()
+	if code!=200 {
+		s,_ := elems[1].Value().StringValueOK()
+		dataerr = fmt.Errorf("%v",s)
+	}
+	return
+}
@@ -0,0 +1,118 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	bson "github.com/mad-day/bsonbox/bsoncore"
+	"fmt"
+	"io"
+)
+
+// The maximum size of a preview in bytes. Larger previews are left out.
+var MaxPreview = 1<<16
+
+// The metadata of a remote file.
+type FileMeta struct{
+	// The document, the MetadataAdapter of the peer has created.
+	Meta bson.Document
+	
+	// The size of the file or -1, if unknown.
+	Size int64
+	
+	// The MIME type and the content of the preview, if requested and available.
+	PreviewType string
+	Preview     []byte
+}
+
+// Determines the size of a file. Returns -1, if unknown.
+func fileSize(fs FileSystem, p Path) int64 {
+	fra,ok := fs.(FileSystemRA)
+	if !ok { return -1 }
+	f,err := fra.OpenRA(p)
+	if err!=nil { return -1 }
+	defer f.Close()
+	n,err := f.Seek(0,io.SeekEnd)
+	if err!=nil { return -1 }
+	return n
+}
+
+func (c *connServer) getMeta(p Path, req bson.Document) bson.Document {
+	if c.denied(p) { return pack("putmeta",404,"txt",ENoFile.Error()) }
+	size := fileSize(c.fs(),p)
+	var doc bson.Document
+	var err error
+	if c.Meta!=nil { doc,err = c.Meta(c.fs(),p) }
+	if doc==nil && size<0 {
+		// Make sure, the file exists.
+		f,oerr := c.fs().Open(p)
+		if oerr!=nil { return pack("putmeta",404,"txt",oerr.Error()) }
+		f.Close()
+	}
+	if doc==nil || err!=nil {
+		doc = pack("_",p[0],"f",p[1])
+	}
+	res := []interface{}{"putmeta",200,"meta",doc,"size",size}
+	if pv,_ := req.Lookup("preview").BooleanOK(); pv && c.Preview!=nil {
+		mime,data,err := c.Preview(c.fs(),p)
+		if err==nil && len(data)>0 && len(data)<=MaxPreview {
+			res = append(res,"mime",mime,"preview",data)
+		}
+	}
+	return pack(res...)
+}
+
+/*
+Fetches the metadata of a file. If preview is set, a small preview, such as
+a cover thumbnail, is included, if the peer has one.
+*/
+func (c *Client) GetMeta(path Path, preview bool) (m *FileMeta, dataerr, err error) {
+	defer c.lock()()
+	var msg bson.Document
+	var elems []bson.Element
+	err = c.write(pack("getmeta",path[0],"f",path[1],"preview",preview))
+	if err!=nil { return }
+	msg,err = c.readMessage()
+	if err!=nil { return }
+	defer c.pc.Free(msg)
+	
+	elems,err = msg.Elements()
+	if err!=nil { return }
+	
+	if len(elems)<2 { err = EProtocolError; return }
+	
+	code,_ := elems[0].Value().Int32OK()
+	if code!=200 {
+		s,_ := elems[1].Value().StringValueOK()
+		dataerr = fmt.Errorf("%v",s)
+		return
+	}
+	m = &FileMeta{Size:-1}
+	doc,_ := msg.Lookup("meta").DocumentOK()
+	m.Meta = append(bson.Document(nil),doc...)
+	if i,ok := msg.Lookup("size").Int64OK(); ok { m.Size = i }
+	m.PreviewType,_ = msg.Lookup("mime").StringValueOK()
+	if _,data,ok := msg.Lookup("preview").BinaryOK(); ok {
+		m.Preview = append([]byte(nil),data...)
+	}
+	return
+}
@@ -29,6 +29,9 @@ import (
 	"github.com/maxymania/synapse/proto"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"errors"
+	"time"
 )
 
 var ECryptoError = fmt.Errorf("p2p: Crypto Error")
@@ -45,9 +48,52 @@ type mqueue chan bson.Document
 */
 
 type Server struct{
-	Arena proto.Allocator
-	FS    FileSystem
-	KP    proto.KeyPair
+	Arena  proto.Allocator
+	FS     FileSystem
+	KP     proto.KeyPair
+	Hashes *HashCache
+	
+	// Optional. Hidden files are neither listed nor served.
+	Hide   func(p Path) bool
+	
+	// Optional. Provides the metadata for file listings. fs is the FileSystem, as the peer sees it.
+	Meta   func(fs FileSystem, p Path) (bson.Document,error)
+	
+	// Optional. Limits the upload bandwidth.
+	Upload *Throttle
+	
+	// Optional. Limits the number of concurrent uploads across all connections.
+	Slots  *Slots
+	
+	// Optional. Verifies peers, that log in. Without it, logins are refused.
+	Auth   PeerAuth
+	
+	// If set, files are only served to peers, that have logged in.
+	RequireAuth bool
+	
+	// Optional. Tells, whether the peer may access the file.
+	// peer is nil for anonymous connections.
+	Allow  func(peer *Peer, p Path) bool
+	
+	// Optional. Receives the instant messages. If it returns an error, the message is refused.
+	Inbox  func(m *Message) error
+	
+	// Optional. Creates a small preview of a file, such as a cover thumbnail.
+	// fs is the FileSystem, as the peer sees it.
+	Preview func(fs FileSystem, p Path) (mime string, data []byte, err error)
+	
+	// How often an idle connection is probed. Defaults to 1 minute. A negative value disables it.
+	Keepalive   time.Duration
+	
+	// If set, the connection is closed, once it was not used for that long.
+	IdleTimeout time.Duration
+	
+	// Optional. Searches the shared files. The results are filtered like listings.
+	Search func(terms bson.Document, max int) []SearchResult
+}
+
+func (s *Server) hidden(p Path) bool {
+	return s.Hide!=nil && s.Hide(p)
 }
 
 type connServer struct{
@@ -57,6 +103,15 @@ type connServer struct{
 	outhi  mqueue // High priority queue
 	outlo  mqueue // Low priority queue
 	downl  fileQueue
+	live   sync.Map // Transfer ID -> *xstate, until the transfer has ended
+	wake   signal   // A checksum is ready
+	sa     *proto.ServerAuth // Pending peer login
+	ka     keepalive
+	
+	pm     sync.Mutex
+	who    *Peer
+	view   FileSystem
+	lim    *Limiter
 }
 
 
@@ -68,6 +123,8 @@ func (s *Server) prepare(conn io.ReadWriteCloser) *connServer {
 	t.outhi = make(mqueue,32)
 	t.outlo = make(mqueue,16)
 	t.downl = make(fileQueue,8) // 8 Downloads gleichzeitig
+	t.wake = make(signal,1)
+	t.setPeer(nil)
 	return t
 }
 
@@ -81,7 +138,7 @@ func (c *connServer) destroy() {
 	for {
 		select {
 		case felem := <- c.downl:
-			if felem.fobj!=nil { felem.fobj.Close() }
+			if felem.fobj!=nil { felem.close() }
 		default: return
 		}
 	}
@@ -90,50 +147,203 @@ func (c *connServer) destroy() {
 func (c *connServer) writer() {
 	for {
 		select {
-		case <- c.alive:
+		case <- c.alive: return
 		case msg := <- c.outhi: c.pc.WriteDocument(msg)
 		default:
 		}
 		select {
-		case <- c.alive:
+		case <- c.alive: return
 		case msg := <- c.outhi: c.pc.WriteDocument(msg)
-		case msg := <- c.outlo: c.pc.WriteDocument(msg)
+		case msg := <- c.outlo:
+			if !c.isDropped(msg) { c.pc.WriteDocument(msg) }
 		}
 	}
 }
 
-func (c *connServer) filewrite(felem queueElement) {
-	if felem.fobj==nil { return }
-	defer felem.fobj.Close()
-	{
-		d := pack("d",felem.path[0],"f",felem.path[1])
-		c.outlo <- pack("dl.start",d)
+// Enqueues a message into the low priority queue. Returns false, if the connection is gone.
+func (c *connServer) sendlo(msg bson.Document) bool {
+	select {
+	case <- c.alive: return false
+	case c.outlo <- msg: return true
 	}
-	buf := make([]byte,1<<13)
-	for {
-		n,_ := felem.fobj.Read(buf)
-		if n==0 { break }
-		c.outlo <- pack("dl.bin",buf[:n])
-		if n<len(buf) { break }
+}
+
+/*
+Computes the checksum of a transfer in the background, so the other transfers
+don't have to wait for it. The filewriter is woken up, once it is done.
+*/
+func (c *connServer) checksum(felem *queueElement) {
+	ch := make(chan rangeSum,1)
+	felem.sum = ch
+	fs,path,off,n := c.fs(),felem.path,felem.off,felem.n
+	go func() {
+		var r rangeSum
+		r.sum,r.size,r.err = c.Hashes.Range(fs,path,off,n)
+		ch <- r
+		c.poke()
+	}()
+}
+
+/*
+Sends the next frame of a transfer. The first frame is "dl.start", the last one
+is "dl.end". Returns false, once the transfer is complete.
+*/
+func (c *connServer) filewrite(felem *queueElement, buf []byte) bool {
+	if !felem.started {
+		felem.started = true
+		r := <- felem.sum
+		if r.err!=nil {
+			// Without the checksum, the client could not verify the transfer.
+			c.sendlo(pack("dl.end",0,"id",felem.id,"err","p2p: checksum: "+r.err.Error()))
+			return false
+		}
+		hdr := pack("d",felem.path[0],"f",felem.path[1],"off",felem.off,"size",r.size,"sha2",r.sum)
+		return c.sendlo(pack("dl.start",hdr,"id",felem.id))
+	}
+	n,err := io.ReadFull(felem.fobj,buf)
+	c.ka.touch(true)
+	c.limiter().Wait(n)
+	if n>0 && !c.sendlo(pack("dl.bin",buf[:n],"id",felem.id)) { return false }
+	switch err {
+	case nil: return true
+	case io.EOF,io.ErrUnexpectedEOF: c.sendlo(pack("dl.end",0,"id",felem.id))
+	default: c.sendlo(pack("dl.end",0,"id",felem.id,"err",err.Error()))
 	}
-	c.outlo <- pack("dl.end",0)
+	return false
 }
 
+/*
+Sends the queued files. The chunks of all active transfers are interleaved
+round-robin, so a large file does not block the small ones behind it.
+Paused transfers are skipped, until they are resumed. So are the transfers,
+whose checksum is not ready yet.
+*/
 func (c *connServer) filewriter() {
+	var active []*queueElement
+	defer func() {
+		for _,felem := range active { felem.close() }
+	}()
+	add := func(felem *queueElement) {
+		if felem.st.isCancelled() {
+			c.ended(felem)
+			return
+		}
+		c.checksum(felem)
+		active = append(active,felem)
+	}
+	buf := make([]byte,1<<13)
 	for {
+		if !hasRunning(active) {
+			select {
+			case <- c.alive: return
+			case felem := <- c.downl: add(&felem)
+			case <- c.wake:
+			}
+		}
+		for more := true; more; {
+			select {
+			case felem := <- c.downl: add(&felem)
+			default: more = false
+			}
+		}
+		keep := active[:0]
+		for _,felem := range active {
+			if !felem.st.isCancelled() && (!felem.runnable() || c.filewrite(felem,buf)) {
+				keep = append(keep,felem)
+			} else {
+				c.ended(felem)
+			}
+		}
+		for i := len(keep) ; i<len(active) ; i++ { active[i] = nil }
+		active = keep
+		select {
+		case <- c.alive: return
+		default:
+		}
+	}
+}
+
+/*
+Queues an upload and returns the response. Without Slots, the upload starts
+immediately, unless the connection's queue is full. A queued upload does not
+keep its file open, the file is opened again, once it gets a slot.
+*/
+func (c *connServer) enqueue(qe queueElement) bson.Document {
+	ok := pack("putfile",200,"d",qe.path[0],"f",qe.path[1],"id",qe.id)
+	qe.st = new(xstate)
+	c.live.Store(qe.id,qe.st)
+	if c.Slots==nil {
+		select {
+		case c.downl <- qe: return ok
+		default:
+		}
+		qe.fobj.Close()
+		c.live.Delete(qe.id)
+		return pack("putfile",204,"txt","queue ran full")
+	}
+	r := &slotReq{qe:qe,conn:c,grant:c.grant}
+	r.qe.fobj = nil
+	r.notify = func(pos int) {
 		select {
+		case c.outhi <- pack("dl.queue",pos,"id",qe.id):
 		case <- c.alive:
-		case felem := <- c.downl: c.filewrite(felem)
 		}
 	}
+	pos,granted := c.Slots.acquire(c.slotKey(),r)
+	if !granted {
+		qe.fobj.Close()
+		c.live.Delete(qe.id)
+		return pack("putfile",503,"txt","queue ran full")
+	}
+	if pos>0 {
+		qe.fobj.Close()
+		return pack("putfile",202,"pos",pos,"id",qe.id)
+	}
+	qe.release = c.Slots.release
+	if !c.grant(&qe) { c.ended(&qe) }
+	return ok
+}
+
+// The key, under which the uploads of the peer wait for a slot.
+func (c *connServer) slotKey() interface{} {
+	if p := c.peer(); p!=nil { return p.Domain }
+	return c
+}
+
+// Starts an upload, that got a slot. A queued upload opens its file here.
+func (c *connServer) grant(qe *queueElement) bool {
+	if qe.fobj==nil {
+		var err error
+		qe.fobj,err = OpenRange(c.fs(),qe.path,qe.off,qe.n)
+		if err!=nil {
+			select {
+			case c.outhi <- pack("dl.end",0,"id",qe.id,"err",err.Error()):
+			case <- c.alive:
+			}
+			return false
+		}
+	}
+	select {
+	case <- c.alive: return false
+	case c.downl <- *qe:
+	}
+	select {
+	case <- c.alive:
+		// The connection died meanwhile. Release what is left in the queue.
+		c.destroy()
+	default:
+	}
+	return true
 }
 
 func (c *connServer) serve() {
 	defer c.pc.Close()
 	defer c.destroy()
+	if c.Slots!=nil { defer c.Slots.cancel(c) }
 	defer close(c.alive)
 	go c.writer()
 	go c.filewriter()
+	go c.ka.run(c.alive,c.Keepalive,c.IdleTimeout,c.ping,func() { c.pc.Close() })
 	for {
 		err := c.serveReq()
 		if err!=nil { return }
@@ -148,6 +358,23 @@ func (c *connServer) serveReq() (err error) {
 	defer c.pc.Free(msg)
 	elems,err = msg.Elements()
 	if len(elems)<1 { return }
+	switch elems[0].Key() {
+	case "ping":
+		c.ka.touch(false)
+		ts,_ := elems[0].Value().Int64OK()
+		c.outhi <- pack("pong",ts)
+		return
+	case "pong":
+		c.ka.touch(false)
+		ts,_ := elems[0].Value().Int64OK()
+		c.ka.pong(ts)
+		return
+	}
+	c.ka.touch(true)
+	if r,ok := authReply[elems[0].Key()]; ok && c.RequireAuth && c.peer()==nil {
+		c.outhi <- pack(r,401,"txt",ENotAuthorized.Error())
+		return
+	}
 	switch string(elems[0].KeyBytes()) {
 	case "hs.s1":
 		send = c.KP.Step1()
@@ -166,20 +393,68 @@ func (c *connServer) serveReq() (err error) {
 		var qe queueElement
 		qe.path[0],_ = elems[0].Value().StringValueOK()
 		qe.path[1],_ = elems[1].Value().StringValueOK()
-		qe.fobj,err = c.FS.Open(qe.path)
+		qe.path = normPath(qe.path)
+		qe.id,_ = msg.Lookup("id").Int32OK()
+		qe.n = -1
+		if i,ok := msg.Lookup("off").Int64OK(); ok && i>0 { qe.off = i }
+		if i,ok := msg.Lookup("len").Int64OK(); ok && i>=0 { qe.n = i }
+		if c.denied(qe.path) {
+			err = ENoFile
+		} else {
+			qe.fobj,err = OpenRange(c.fs(),qe.path,qe.off,qe.n)
+		}
 		if err!=nil {
 			c.outhi <- pack("putfile",404,"txt",err.Error())
 			err = nil
 			return
 		}
-		select {
-		case c.downl <- qe:
-			c.outhi<- pack("putfile",200,"d",qe.path[0],"f",qe.path[1])
+		c.outhi <- c.enqueue(qe)
+	case "gethash":
+		if len(elems)<2 { return }
+		var path Path
+		path[0],_ = elems[0].Value().StringValueOK()
+		path[1],_ = elems[1].Value().StringValueOK()
+		path = normPath(path)
+		if c.denied(path) {
+			c.outhi <- pack("puthash",404,"txt",ENoFile.Error())
 			return
-		default:
 		}
-		qe.fobj.Close()
-		c.outhi <- pack("putfile",204,"txt","queue ran full")
+		// Hashing a large file takes a while. Do not block the other requests.
+		fs := c.fs()
+		go func() {
+			h,herr := c.Hashes.Get(fs,path)
+			if herr!=nil {
+				c.sendhi(pack("puthash",404,"txt",herr.Error()))
+				return
+			}
+			c.sendhi(pack("puthash",200,"root",h.Root,"size",h.Size,"pieces",h.concat()))
+		}()
+	case "auth.s1":
+		req,_ := elems[0].Value().DocumentOK()
+		c.outhi <- c.authStep1(req)
+	case "auth.s2":
+		resp,_ := elems[0].Value().DocumentOK()
+		c.authStep2(resp)
+	case "cancel","pause","resume":
+		id,_ := elems[0].Value().Int32OK()
+		c.control(elems[0].Key(),id)
+	case "getmeta":
+		if len(elems)<2 { return }
+		var path Path
+		path[0],_ = elems[0].Value().StringValueOK()
+		path[1],_ = elems[1].Value().StringValueOK()
+		path = normPath(path)
+		c.outhi <- c.getMeta(path,msg)
+	case "msg":
+		c.outhi <- c.message(msg)
+	case "search":
+		terms,_ := elems[0].Value().DocumentOK()
+		c.outhi <- c.search(terms,msg)
+	case "listdirs":
+		c.outhi <- c.listDirs(msg)
+	case "listfiles":
+		dir,_ := elems[0].Value().StringValueOK()
+		c.outhi <- c.listFiles(dir,msg)
 	}
 	
 	return
@@ -215,6 +490,27 @@ func d2path(d bson.Document) (p Path) {
 type ClientContext struct{
 	Arena  proto.Allocator
 	Target TargetStore
+	
+	// Optional. Limits the download bandwidth.
+	Download *Throttle
+	
+	// How often a download is retried, if the server's upload queue is full.
+	// Defaults to 3. A negative value disables retries.
+	BusyRetries int
+	
+	// The delay between those retries. Defaults to 10 seconds.
+	BusyDelay time.Duration
+	
+	// Optional. Receives the events of all transfers. It is called from the
+	// goroutine, that receives the data, so it should not block.
+	OnEvent func(ev Event)
+	
+	// How often an idle connection is probed. A connection, that does not
+	// answer, is closed. Defaults to 1 minute. A negative value disables it.
+	Keepalive   time.Duration
+	
+	// If set, the connection is closed, once it was not used for that long.
+	IdleTimeout time.Duration
 }
 
 type Client struct{
@@ -223,9 +519,16 @@ type Client struct{
 	alive   signal
 	appmsg  mqueue
 	filemsg mqueue
-	toks    PathTokenMap
+	toks    idTokenMap
+	nextid  int32
+	lim     *Limiter
+	cancel  chan int32
+	xfers   sync.Map // Transfer ID -> Path
+	
+	ka      keepalive
 	
-	pcm     sync.Mutex
+	pcm     sync.Mutex // Held during a request and its response
+	wm      sync.Mutex // Held while writing
 }
 
 func (cc *ClientContext) prepare(conn io.ReadWriteCloser) *Client {
@@ -235,6 +538,7 @@ func (cc *ClientContext) prepare(conn io.ReadWriteCloser) *Client {
 	t.alive   = make(signal)
 	t.appmsg  = make(mqueue,32)
 	t.filemsg = make(mqueue,8)
+	t.cancel  = make(chan int32,8)
 	return t
 }
 
@@ -242,6 +546,11 @@ func (c *Client) lock() func() {
 	c.pcm.Lock(); return c.pcm.Unlock
 }
 
+func (c *Client) write(doc bson.Document) error {
+	c.wm.Lock(); defer c.wm.Unlock()
+	return c.pc.WriteDocument(doc)
+}
+
 func (c *Client) reader() {
 	for {
 		select {
@@ -253,7 +562,22 @@ func (c *Client) reader() {
 		elem,err := msg.IndexErr(0)
 		if err!=nil { c.pc.Free(msg); continue }
 		kb := elem.KeyBytes()
+		switch string(kb) {
+		case "ping","pong":
+			c.ka.touch(false)
+			ts,_ := elem.Value().Int64OK()
+			if kb[1]=='i' {
+				c.write(pack("pong",ts))
+			} else {
+				c.ka.pong(ts)
+			}
+			c.pc.Free(msg)
+			continue
+		}
+		c.ka.touch(true)
 		if hasprefix(kb,"dl.") {
+			// Delaying the next read throttles the sender as well.
+			c.lim.Wait(len(msg))
 			c.filemsg <- msg
 		} else {
 			c.appmsg <- msg
@@ -267,41 +591,87 @@ func (c *Client) reader() {
 		}
 	}
 }
+/*
+Receives the transfers. The frames of concurrent transfers are told apart by
+their transfer ID.
+*/
 func (c *Client) filewriter() {
-	var cf io.WriteCloser
-	setFile := func(ncf io.WriteCloser) {
-		if cf!=nil { cf.Close() }
-		cf = ncf
-	}
-	defer setFile(nil)
+	active := make(map[int32]*download)
+	cancelled := make(map[int32]bool)
+	defer func() {
+		for id,cd := range active {
+			c.xfers.Delete(id)
+			cd.finish(ETruncated)
+		}
+		// The transfers, that still wait for an upload slot.
+		c.xfers.Range(func(k, v interface{}) bool {
+			c.endPending(k.(int32),ETruncated)
+			return true
+		})
+	}()
 	for {
 		var msg bson.Document
 		select {
 		case <- c.alive: return
+		case id := <- c.cancel:
+			// Ignore transfers, that have already ended.
+			if _,ok := c.xfers.Load(id); !ok { continue }
+			if cd := active[id]; cd!=nil {
+				c.toks.Take(id)
+				c.xfers.Delete(id)
+				cd.finish(ECancelled)
+				delete(active,id)
+			} else {
+				c.endPending(id,ECancelled)
+			}
+			cancelled[id] = true
+			continue
 		case msg = <- c.filemsg:
 		}
 		elem,_ := msg.IndexErr(0)
+		id,_ := msg.Lookup("id").Int32OK()
+		if cancelled[id] {
+			// Frames, the server has sent before it got the cancel command.
+			if string(elem.KeyBytes())=="dl.end" { delete(cancelled,id) }
+			goto done
+		}
 		switch string(elem.KeyBytes()) {
 		case "dl.start":
 			hdr,ok := elem.Value().DocumentOK()
 			if !ok { goto done }
 			path := d2path(hdr)
-			token := c.toks.Get(path)
-			c.toks.Put(path,nil)
-			ncf,err := c.Target.Create(token,path)
-			if err!=nil { goto done }
-			setFile(ncf)
+			off,_ := hdr.Lookup("off").Int64OK()
+			token := c.toks.Take(id)
+			if cd := active[id]; cd!=nil { cd.finish(ETruncated) }
+			delete(active,id)
+			ncf,err := c.openTarget(token,path,off)
+			if err!=nil {
+				c.xfers.Delete(id)
+				c.emit(Event{Kind:EvDone,Token:token,Path:path,ID:id,Off:off,Total:-1,Err:err})
+				goto done
+			}
+			active[id] = newDownload(c.ClientContext,id,token,path,off,ncf,hdr)
 		case "dl.bin":
 			_,data,ok := elem.Value().BinaryOK()
 			if !ok { goto done }
-			if cf!=nil {
-				cf.Write(data)
+			if cd := active[id]; cd!=nil {
+				cd.write(data)
 			}
+		case "dl.queue":
+			pos,_ := elem.Value().Int32OK()
+			c.emit(Event{Kind:EvQueued,Token:c.toks.Get(id),ID:id,Total:-1,Queue:int(pos)})
 		case "dl.end":
-			if cf!=nil {
-				cf.Close()
-				cf = nil
+			var serr error
+			if s,ok := msg.Lookup("err").StringValueOK(); ok { serr = errors.New(s) }
+			if cd := active[id]; cd!=nil {
+				cd.finish(serr)
+				delete(active,id)
+			} else {
+				// The server gave up, before the transfer started.
+				if serr==nil { serr = ETruncated }
+				c.endPending(id,serr)
 			}
+			c.xfers.Delete(id)
 		}
 		done:
 		c.pc.Free(msg)
@@ -309,18 +679,41 @@ func (c *Client) filewriter() {
 }
 
 
+// Ends a transfer, that has not started yet, e.g. because it waits for an upload slot.
+func (c *Client) endPending(id int32, err error) {
+	p,ok := c.xfers.Load(id)
+	if !ok { return }
+	c.xfers.Delete(id)
+	c.emit(Event{Kind:EvDone,Token:c.toks.Take(id),Path:p.(Path),ID:id,Total:-1,Err:err})
+}
+
+func (c *Client) openTarget(token Token, path Path, off int64) (io.WriteCloser,error) {
+	if tt,ok := token.(TokenTarget); ok { return tt.Open(path,off) }
+	if off==0 { return c.Target.Create(token,path) }
+	tse,ok := c.Target.(TargetStoreEx)
+	if !ok { return nil,EDlRejected }
+	return tse.Open(token,path,off)
+}
+
 func (cc *ClientContext) NewClient(conn io.ReadWriteCloser) (*Client,error) {
+	return cc.NewPeerClient(conn,"")
+}
+
+// Like NewClient, but the domain of the peer is known, so the per-peer bandwidth limit applies.
+func (cc *ClientContext) NewPeerClient(conn io.ReadWriteCloser, domain string) (*Client,error) {
 	if conn==nil { return nil,fmt.Errorf("p2p: conn = ",conn) }
 	c := cc.prepare(conn)
+	c.lim = cc.Download.Limiter(domain)
 	go c.reader()
 	go c.filewriter()
+	go c.ka.run(c.alive,cc.Keepalive,cc.IdleTimeout,c.ping,func() { c.Close() })
 	return c,nil
 }
 
 func (c *Client) Alive() bool {
 	select {
-	case <- c.alive: return true
-	default: return false
+	case <- c.alive: return false
+	default: return true
 	}
 	panic("unreachable")
 }
@@ -354,7 +747,7 @@ func (c *Client) AuthStep2(sa *proto.ServerAuth, pub []byte, dom string) (ok boo
 func (c *Client) step1(sa *proto.ServerAuth) (pl bson.Document, err error) {
 	defer c.lock()()
 	var msg bson.Document
-	err = c.pc.WriteDocument(pack("hs.s1",""))
+	err = c.write(pack("hs.s1",""))
 	if err!=nil { return }
 	msg,err = c.readMessage()
 	if err!=nil { return }
@@ -366,7 +759,7 @@ func (c *Client) step1(sa *proto.ServerAuth) (pl bson.Document, err error) {
 func (c *Client) step2(pl bson.Document, sa *proto.ServerAuth) (ok bool,err error) {
 	defer c.lock()()
 	var msg bson.Document
-	err = c.pc.WriteDocument(pack("hs.s2",pl))
+	err = c.write(pack("hs.s2",pl))
 	if err!=nil { return }
 	msg,err = c.readMessage()
 	if err!=nil { return }
@@ -377,11 +770,76 @@ func (c *Client) step2(pl bson.Document, sa *proto.ServerAuth) (ok bool,err erro
 }
 
 func (c *Client) GetFile(tok Token,path Path) (dataerr, err error) {
+	return c.GetRange(tok,path,0,-1)
+}
+
+/*
+Resumes an interrupted download, starting at the end of the partial target.
+The TargetStore must implement TargetStoreEx.
+*/
+func (c *Client) Resume(tok Token,path Path) (dataerr, err error) {
+	tse,ok := c.Target.(TargetStoreEx)
+	if !ok { return nil,EDlRejected }
+	off,err := tse.Partial(tok,path)
+	if err!=nil { return }
+	return c.GetRange(tok,path,off,-1)
+}
+
+var eBusy = errors.New("p2p: upload queue ran full")
+
+func (cc *ClientContext) busyRetries() int {
+	if cc.BusyRetries==0 { return 3 }
+	return cc.BusyRetries
+}
+func (cc *ClientContext) busyDelay() time.Duration {
+	if cc.BusyDelay<=0 { return 10*time.Second }
+	return cc.BusyDelay
+}
+
+/*
+Downloads n bytes of the file, starting at offset off. If n is negative,
+the rest of the file is downloaded. For off>0, the TargetStore must
+implement TargetStoreEx.
+
+If the server's upload queue is full, the request is retried later
+(see ClientContext.BusyRetries). If the request is queued, the queue
+position is reported as EvQueued event.
+*/
+func (c *Client) GetRange(tok Token,path Path,off,n int64) (dataerr, err error) {
+	_,dataerr,err = c.Fetch(tok,path,off,n)
+	return
+}
+
+/*
+Like GetRange, but returns the ID of the transfer, that can be passed to
+Cancel, Pause or Unpause.
+*/
+func (c *Client) Fetch(tok Token,path Path,off,n int64) (id int32, dataerr, err error) {
+	for i := 0 ; ; i++ {
+		id,dataerr,err = c.getRange(tok,path,off,n)
+		if err!=nil || dataerr!=eBusy || i>=c.busyRetries() { break }
+		select {
+		case <- time.After(c.busyDelay()):
+		case <- c.alive: return id,dataerr,io.EOF
+		}
+	}
+	return
+}
+
+func (c *Client) getRange(tok Token,path Path,off,n int64) (id int32, dataerr, err error) {
 	defer c.lock()()
 	var msg bson.Document
 	var elems []bson.Element
-	c.toks.Put(path,tok)
-	err = c.pc.WriteDocument(pack("getfile",path[0],"f",path[1]))
+	id = atomic.AddInt32(&c.nextid,1)
+	c.toks.Put(id,tok)
+	c.xfers.Store(id,path)
+	defer func() {
+		if err!=nil || dataerr!=nil { c.toks.Take(id); c.xfers.Delete(id) }
+	}()
+	req := []interface{}{"getfile",path[0],"f",path[1],"id",id}
+	if off>0 { req = append(req,"off",off) }
+	if n>=0 { req = append(req,"len",n) }
+	err = c.write(pack(req...))
 	if err!=nil { return }
 	msg,err = c.readMessage()
 	if err!=nil { return }
@@ -393,7 +851,14 @@ func (c *Client) GetFile(tok Token,path Path) (dataerr, err error) {
 	if len(elems)<2 { err = EProtocolError; return }
 	
 	code,_ := elems[0].Value().Int32OK()
-	if code!=200 {
+	switch code {
+	case 200:
+	case 202:
+		pos,_ := msg.Lookup("pos").Int32OK()
+		c.emit(Event{Kind:EvQueued,Token:tok,Path:path,ID:id,Off:off,Total:-1,Queue:int(pos)})
+	case 204,503:
+		dataerr = eBusy
+	default:
 		s,_ := elems[1].Value().StringValueOK()
 		dataerr = fmt.Errorf("%v",s)
 	}
@@ -401,4 +866,34 @@ func (c *Client) GetFile(tok Token,path Path) (dataerr, err error) {
 	return
 }
 
-
+/*
+Fetches the content hash of a file. The piece hashes are checked against the root hash.
+*/
+func (c *Client) GetHash(path Path) (h *FileHash, dataerr, err error) {
+	defer c.lock()()
+	var msg bson.Document
+	var elems []bson.Element
+	err = c.write(pack("gethash",path[0],"f",path[1]))
+	if err!=nil { return }
+	msg,err = c.readMessage()
+	if err!=nil { return }
+	defer c.pc.Free(msg)
+	
+	elems,err = msg.Elements()
+	if err!=nil { return }
+	
+	if len(elems)<2 { err = EProtocolError; return }
+	
+	code,_ := elems[0].Value().Int32OK()
+	if code!=200 {
+		s,_ := elems[1].Value().StringValueOK()
+		dataerr = fmt.Errorf("%v",s)
+		return
+	}
+	_,root,_ := msg.Lookup("root").BinaryOK()
+	_,pcs,_ := msg.Lookup("pieces").BinaryOK()
+	size,_ := msg.Lookup("size").Int64OK()
+	h = &FileHash{append([]byte(nil),root...),size,splitPieces(append([]byte(nil),pcs...))}
+	if !h.Verify() { h,dataerr = nil,EIntegrity }
+	return
+}
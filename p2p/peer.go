@@ -0,0 +1,183 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	bson "github.com/mad-day/bsonbox/bsoncore"
+	"github.com/maxymania/synapse/proto"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+var ENotAuthorized = errors.New("p2p: Not authorized")
+var ENoPeerAuth = errors.New("p2p: Peer login not supported")
+
+// The authenticated identity of the remote peer.
+type Peer struct{
+	Domain string
+	Pub    []byte
+}
+
+/*
+Verifies, that the public key belongs to the domain. The peer has already
+proven, that it owns the private key. server.PeerConnectAuth implements it.
+*/
+type PeerAuth interface{
+	VerifyPeer(domain string, pub []byte) error
+}
+
+/*
+Optionally implemented by a FileSystem, that serves a different view to
+each peer. peer is nil for anonymous connections.
+*/
+type FileSystemPeer interface{
+	FileSystem
+	ForPeer(peer *Peer) FileSystem
+}
+
+// The replies of the commands, that are refused, if Server.RequireAuth is set.
+var authReply = map[string]string{
+	"getfile": "putfile",
+	"gethash": "puthash",
+	"getmeta": "putmeta",
+	"listdirs": "putdirs",
+	"listfiles": "putfiles",
+	"msg": "msgack",
+	"search": "putsearch",
+}
+
+// Returns the peer, or nil, if the connection is anonymous.
+func (c *connServer) peer() *Peer {
+	defer c.lock()()
+	return c.who
+}
+
+// Returns the FileSystem, as it is seen by the peer.
+func (c *connServer) fs() FileSystem {
+	defer c.lock()()
+	return c.view
+}
+
+func (c *connServer) limiter() *Limiter {
+	defer c.lock()()
+	return c.lim
+}
+
+func (c *connServer) lock() func() {
+	c.pm.Lock(); return c.pm.Unlock
+}
+
+func (c *connServer) setPeer(p *Peer) {
+	view := c.FS
+	if fsp,ok := c.FS.(FileSystemPeer); ok { view = fsp.ForPeer(p) }
+	dom := ""
+	if p!=nil { dom = p.Domain }
+	lim := c.Upload.Limiter(dom)
+	defer c.lock()()
+	c.who,c.view,c.lim = p,view,lim
+}
+
+// Tells, whether the file may be neither listed nor served to the peer.
+func (c *connServer) denied(p Path) bool {
+	if c.hidden(p) { return true }
+	if df,ok := c.fs().(DirFilter); ok && !df.AllowDir(p[0]) { return true }
+	return c.Allow!=nil && !c.Allow(c.peer(),p)
+}
+
+// First step of the peer login: answers the challenge.
+func (c *connServer) authStep1(req bson.Document) bson.Document {
+	if c.Auth==nil { return pack("auth.s1",501,"txt",ENoPeerAuth.Error()) }
+	sa := &proto.ServerAuth{Rand:rand.Reader}
+	chal := sa.Step1(req)
+	if chal==nil { return pack("auth.s1",400,"txt",ECryptoError.Error()) }
+	c.sa = sa
+	return pack("auth.s1",200,"chal",chal)
+}
+
+// Second step of the peer login: checks the response and verifies the domain.
+func (c *connServer) authStep2(resp bson.Document) {
+	sa := c.sa
+	c.sa = nil
+	if sa==nil || !sa.Step2(resp) {
+		c.outhi <- pack("auth.s2",403,"txt",ENotAuthorized.Error())
+		return
+	}
+	// Verifying the domain may take a while. Do not block the other requests.
+	go func() {
+		if err := c.Auth.VerifyPeer(sa.Domain,sa.Pub); err!=nil {
+			c.sendhi(pack("auth.s2",403,"txt",err.Error()))
+			return
+		}
+		c.setPeer(&Peer{sa.Domain,sa.Pub})
+		c.sendhi(pack("auth.s2",200,"domain",sa.Domain))
+	}()
+}
+
+func (c *connServer) sendhi(msg bson.Document) {
+	select {
+	case c.outhi <- msg:
+	case <- c.alive:
+	}
+}
+
+// Sends a login step and returns the response.
+func (c *Client) authStep(key string, doc bson.Document) (resp bson.Document, dataerr, err error) {
+	var msg bson.Document
+	var elems []bson.Element
+	err = c.write(pack(key,doc))
+	if err!=nil { return }
+	msg,err = c.readMessage()
+	if err!=nil { return }
+	defer c.pc.Free(msg)
+	
+	elems,err = msg.Elements()
+	if err!=nil { return }
+	
+	if len(elems)<2 { err = EProtocolError; return }
+	
+	code,_ := elems[0].Value().Int32OK()
+	if code!=200 {
+		s,_ := elems[1].Value().StringValueOK()
+		dataerr = fmt.Errorf("%v",s)
+		return
+	}
+	resp,_ = msg.Lookup("chal").DocumentOK()
+	resp = append(bson.Document(nil),resp...)
+	return
+}
+
+/*
+Logs in to the server as the owner of the key pair, so the server knows,
+which peer requests its files. dataerr is set, if the server refused the login.
+*/
+func (c *Client) Login(kp *proto.KeyPair) (dataerr, err error) {
+	defer c.lock()()
+	var chal bson.Document
+	chal,dataerr,err = c.authStep("auth.s1",kp.Step1())
+	if err!=nil || dataerr!=nil { return }
+	resp := kp.Step2(chal)
+	if resp==nil { return ECryptoError,nil }
+	_,dataerr,err = c.authStep("auth.s2",resp)
+	return
+}
@@ -0,0 +1,240 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Optionally implemented by a Token, that knows the domain of the peer, the file is downloaded from.
+type TokenSource interface{
+	Source() string
+}
+
+type sfToken string
+func (t sfToken) Source() string { return string(t) }
+
+// The sidecar, that records, where a downloaded file came from.
+type SourceInfo struct{
+	Domain string    `json:"domain"`
+	Dir    string    `json:"dir"`
+	File   string    `json:"file"`
+	Size   int64     `json:"size"`
+	Time   time.Time `json:"time"`
+}
+
+/*
+A TargetStore, that never overwrites a file. Downloads are written into a
+".part" file, that is moved to its final name, once the download is
+complete. If the name is taken, a suffix like " (1)" is added.
+
+The final name is taken with a hard link, that fails, if the name exists. On
+file systems without hard links (like FAT or many SMB shares), the name is
+reserved with an empty placeholder first, that is replaced by a rename.
+*/
+type SafeFolder struct{
+	Dir string
+	
+	// If set, the files of each peer are placed in a subfolder, named after the domain.
+	PerPeer bool
+	
+	// If set, a sidecar "<name>.meta.json" records the source of each file.
+	Sidecar bool
+	
+	m    sync.Mutex
+	busy map[string]bool
+}
+
+var _ TargetStoreEx = (*SafeFolder)(nil)
+var _ TargetWriter = (*sfFile)(nil)
+
+// Creates a token for a download from the given domain.
+func (sf *SafeFolder) Token(domain string) Token { return sfToken(domain) }
+
+func source(t Token) string {
+	if ts,ok := t.(TokenSource); ok { return ts.Source() }
+	return ""
+}
+
+func (sf *SafeFolder) dir(t Token) string {
+	dom := source(t)
+	if !sf.PerPeer || dom=="" { return sf.Dir }
+	return filepath.Join(sf.Dir,CleanUpFile(dom))
+}
+
+/*
+The name of the partial file. It only depends on the source, so an
+interrupted download can be resumed. While it is open, further writers for
+the same file get their own partial file (see reserve).
+*/
+func (sf *SafeFolder) part(t Token, p Path) string {
+	h := sha256.Sum256([]byte(source(t)+"\x00"+p[0]+"\x00"+p[1]))
+	name := "."+CleanUpFile(p[1])+"."+hex.EncodeToString(h[:6])+".part"
+	return filepath.Join(sf.dir(t),name)
+}
+
+func (sf *SafeFolder) Create(t Token, p Path) (io.WriteCloser,error) {
+	return sf.Open(t,p,0)
+}
+
+func (sf *SafeFolder) Open(t Token, p Path, off int64) (io.WriteCloser,error) {
+	if t==nil { return nil,EDlRejected }
+	err := os.MkdirAll(sf.dir(t),0777)
+	if err!=nil { return nil,err }
+	name,spare := sf.reserve(sf.part(t,p))
+	// A spare partial file can't be resumed.
+	if spare && off>0 { sf.release(name); return nil,EDlRejected }
+	flag := os.O_WRONLY|os.O_CREATE
+	if off==0 { flag |= os.O_TRUNC }
+	f,err := os.OpenFile(name,flag,0666)
+	if err!=nil { sf.release(name); return nil,err }
+	_,err = f.Seek(off,io.SeekStart)
+	if err!=nil { f.Close(); sf.release(name); return nil,err }
+	return &sfFile{f,sf,t,p,off,spare},nil
+}
+
+/*
+Marks the partial file as open. If it is already open, a spare name like
+".a.txt.0123456789ab.1.part" is reserved instead, and spare is true.
+*/
+func (sf *SafeFolder) reserve(part string) (name string, spare bool) {
+	sf.m.Lock(); defer sf.m.Unlock()
+	if sf.busy==nil { sf.busy = make(map[string]bool) }
+	name = part
+	for i := 1 ; sf.busy[name] ; i++ {
+		name = strings.TrimSuffix(part,".part")+"."+strconv.Itoa(i)+".part"
+	}
+	sf.busy[name] = true
+	return name,name!=part
+}
+
+func (sf *SafeFolder) release(name string) {
+	sf.m.Lock(); defer sf.m.Unlock()
+	delete(sf.busy,name)
+}
+
+func (sf *SafeFolder) Partial(t Token, p Path) (int64,error) {
+	fi,err := os.Stat(sf.part(t,p))
+	if os.IsNotExist(err) { return 0,nil }
+	if err!=nil { return 0,err }
+	return fi.Size(),nil
+}
+
+// Returns the n-th candidate for the final name: "a.txt", "a (1).txt", "a (2).txt", ...
+func candidate(name string, n int) string {
+	if n==0 { return name }
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name,ext)+" ("+strconv.Itoa(n)+")"+ext
+}
+
+/*
+Moves the partial file to a free name. Returns the final name. If sidecar is
+set, the name of the sidecar is reserved together with it, and the created
+sidecar file is returned.
+*/
+func (sf *SafeFolder) commit(part, dir string, p Path, sidecar bool) (name string, side *os.File, err error) {
+	sf.m.Lock(); defer sf.m.Unlock()
+	base := CleanUpFile(p[1])
+	unside := func() {
+		if side==nil { return }
+		side.Close()
+		os.Remove(side.Name())
+		side = nil
+	}
+	for i := 0 ; ; i++ {
+		name = filepath.Join(dir,candidate(base,i))
+		if sidecar {
+			side,err = os.OpenFile(name+".meta.json",os.O_WRONLY|os.O_CREATE|os.O_EXCL,0666)
+			if os.IsExist(err) { continue }
+			if err!=nil { return }
+		}
+		// A hard link fails, if the name is taken. Unlike a rename.
+		err = os.Link(part,name)
+		if err==nil { err = os.Remove(part); return }
+		if os.IsExist(err) { unside(); continue }
+		
+		// The file system does not support hard links. Reserve the name with an
+		// empty placeholder, that only we replace.
+		var ph *os.File
+		ph,err = os.OpenFile(name,os.O_WRONLY|os.O_CREATE|os.O_EXCL,0666)
+		if os.IsExist(err) { unside(); continue }
+		if err!=nil { unside(); return }
+		ph.Close()
+		err = os.Rename(part,name)
+		if err!=nil { os.Remove(name); unside() }
+		return
+	}
+}
+
+func (sf *SafeFolder) sidecar(side *os.File, t Token, p Path, size int64) error {
+	defer side.Close()
+	data,err := json.MarshalIndent(&SourceInfo{source(t),p[0],p[1],size,time.Now()},"","\t")
+	if err!=nil { return err }
+	_,err = side.Write(data)
+	return err
+}
+
+// A file in a SafeFolder.
+type sfFile struct{
+	*os.File
+	sf  *SafeFolder
+	tok Token
+	p   Path
+	off int64
+	
+	spare bool
+}
+
+func (f *sfFile) Close() error {
+	defer f.sf.release(f.Name())
+	err := f.File.Sync()
+	size,_ := f.File.Seek(0,io.SeekCurrent)
+	if e := f.File.Close(); err==nil { err = e }
+	if err!=nil { return err }
+	_,side,err := f.sf.commit(f.Name(),f.sf.dir(f.tok),f.p,f.sf.Sidecar)
+	if side==nil { return err }
+	if e := f.sf.sidecar(side,f.tok,f.p,size); err==nil { err = e }
+	return err
+}
+
+/*
+Keeps the partial file, so the download can be resumed. See abortFile. A
+spare partial file can't be resumed, and is removed.
+*/
+func (f *sfFile) Abort(err error) error {
+	defer f.sf.release(f.Name())
+	if f.spare {
+		f.File.Close()
+		return os.Remove(f.Name())
+	}
+	return abortFile(f.File,f.off,err)
+}
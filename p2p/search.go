@@ -0,0 +1,75 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	bson "github.com/mad-day/bsonbox/bsoncore"
+	"strconv"
+)
+
+// The maximum number of search results per request.
+const MaxResults = 1<<10
+
+// A file, that matched a search.
+type SearchResult struct{
+	Path Path
+	
+	// The published metadata of the file. It contains the path as "_" and "f".
+	Meta bson.Document
+}
+
+func (c *connServer) search(terms, req bson.Document) bson.Document {
+	if c.Search==nil { return pack("putsearch",501,"txt","search not supported") }
+	max := MaxResults
+	if i,ok := req.Lookup("max").Int32OK(); ok && i>0 && int(i)<max { max = int(i) }
+	db := bson.NewDocumentBuilder()
+	n := 0
+	for _,r := range c.Search(terms,max) {
+		if c.denied(r.Path) { continue }
+		db.AppendDocument(strconv.Itoa(n),r.Meta)
+		n++
+	}
+	return pack("putsearch",200,"list",db.Build())
+}
+
+/*
+Searches the shared files of the peer directly. terms has the same format as
+for an index server query. At most max results are returned. If max is 0,
+the server decides.
+*/
+func (c *Client) Search(terms bson.Document, max int) (res []SearchResult, dataerr, err error) {
+	req := []interface{}{"search",terms}
+	if max>0 { req = append(req,"max",max) }
+	var list []bson.Element
+	list,_,dataerr,err = c.list(pack(req...))
+	for _,elem := range list {
+		doc,ok := elem.Value().DocumentOK()
+		if !ok { continue }
+		var r SearchResult
+		r.Path[0],_ = doc.Lookup("_").StringValueOK()
+		r.Path[1],_ = doc.Lookup("f").StringValueOK()
+		r.Meta = doc
+		res = append(res,r)
+	}
+	return
+}
@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	"sync"
+	"time"
+)
+
+// A waiting upload.
+type slotReq struct{
+	qe     queueElement
+	conn   *connServer
+	
+	// Opens the file and hands the upload over to its connection. Returns false,
+	// if the upload can't start.
+	grant  func(qe *queueElement) bool
+	
+	// Reports the position in the queue (starting at 1).
+	notify func(pos int)
+}
+
+/*
+Limits the number of concurrent uploads across all connections of a Server.
+Uploads, that don't get a slot immediately, wait in a bounded queue. The
+queue is served round-robin per peer, so a single peer can't occupy it, not
+even with several connections. Anonymous connections count as separate peers.
+*/
+type Slots struct{
+	// The number of concurrent uploads. Defaults to 8.
+	Active  int
+	
+	// The number of waiting uploads. Defaults to 64.
+	Waiting int
+	
+	// How often the waiting peers are told their queue position. Defaults to 10 seconds.
+	Interval time.Duration
+	
+	m       sync.Mutex
+	running int
+	nwait   int
+	peers   []interface{}
+	queues  map[interface{}][]*slotReq
+	ticking bool
+}
+
+func (s *Slots) active() int {
+	if s.Active<=0 { return 8 }
+	return s.Active
+}
+func (s *Slots) waiting() int {
+	if s.Waiting<=0 { return 64 }
+	return s.Waiting
+}
+func (s *Slots) interval() time.Duration {
+	if s.Interval<=0 { return 10*time.Second }
+	return s.Interval
+}
+
+/*
+Requests a slot for an upload. If a slot is free, pos is 0 and the caller
+starts the upload itself. Otherwise the request is queued at position pos
+and grant is called, once it gets a slot. If the queue is full, ok is false.
+*/
+func (s *Slots) acquire(peer interface{}, r *slotReq) (pos int, ok bool) {
+	s.m.Lock(); defer s.m.Unlock()
+	if s.running<s.active() {
+		s.running++
+		return 0,true
+	}
+	if s.nwait>=s.waiting() { return 0,false }
+	if s.queues==nil { s.queues = make(map[interface{}][]*slotReq) }
+	q := s.queues[peer]
+	if len(q)==0 { s.peers = append(s.peers,peer) }
+	s.queues[peer] = append(q,r)
+	s.nwait++
+	if !s.ticking {
+		s.ticking = true
+		go s.ticker()
+	}
+	return s.positions()[r],true
+}
+
+// Removes the first waiting request in round-robin order.
+func (s *Slots) next() *slotReq {
+	if len(s.peers)==0 { return nil }
+	peer := s.peers[0]
+	q := s.queues[peer]
+	r := q[0]
+	q[0] = nil
+	q = q[1:]
+	s.peers = s.peers[1:]
+	if len(q)==0 {
+		delete(s.queues,peer)
+	} else {
+		s.queues[peer] = q
+		s.peers = append(s.peers,peer)
+	}
+	s.nwait--
+	return r
+}
+
+// Computes the queue positions of all waiting requests.
+func (s *Slots) positions() map[*slotReq]int {
+	pos := make(map[*slotReq]int,s.nwait)
+	n := 0
+	for round := 0 ; n<s.nwait ; round++ {
+		for _,peer := range s.peers {
+			q := s.queues[peer]
+			if round>=len(q) { continue }
+			n++
+			pos[q[round]] = n
+		}
+	}
+	return pos
+}
+
+// Frees a slot and hands it over to the next waiting request.
+func (s *Slots) release() {
+	s.m.Lock()
+	r := s.next()
+	if r==nil { s.running--; s.m.Unlock(); return }
+	s.m.Unlock()
+	r.qe.release = s.release
+	
+	// The slot is handed over asynchronously, so a busy connection can't block the releasing one.
+	go func() {
+		if !r.grant(&r.qe) { r.conn.ended(&r.qe) }
+	}()
+}
+
+// Removes all waiting requests of a connection, that is gone.
+func (s *Slots) cancel(conn *connServer) {
+	s.m.Lock(); defer s.m.Unlock()
+	s.removeIf(func(r *slotReq) bool { return r.conn==conn })
+}
+
+// Removes a waiting request. Returns false, if it was not found.
+func (s *Slots) remove(conn *connServer, id int32) bool {
+	s.m.Lock(); defer s.m.Unlock()
+	return s.removeIf(func(r *slotReq) bool { return r.conn==conn && r.qe.id==id })>0
+}
+
+// Removes the waiting requests, that match. Returns their number.
+func (s *Slots) removeIf(match func(r *slotReq) bool) (n int) {
+	peers := s.peers[:0]
+	for _,peer := range s.peers {
+		q := s.queues[peer]
+		keep := q[:0]
+		for _,r := range q {
+			if match(r) { n++ } else { keep = append(keep,r) }
+		}
+		for i := len(keep) ; i<len(q) ; i++ { q[i] = nil }
+		if len(keep)==0 { delete(s.queues,peer); continue }
+		s.queues[peer] = keep
+		peers = append(peers,peer)
+	}
+	for i := len(peers) ; i<len(s.peers) ; i++ { s.peers[i] = nil }
+	s.peers = peers
+	s.nwait -= n
+	return
+}
+
+func (s *Slots) ticker() {
+	for {
+		time.Sleep(s.interval())
+		s.m.Lock()
+		if s.nwait==0 { s.ticking = false; s.m.Unlock(); return }
+		pos := s.positions()
+		s.m.Unlock()
+		for r,p := range pos { r.notify(p) }
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package p2p
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A token bucket. The rate is shared with the Throttle, so it can be changed at runtime.
+type bucket struct{
+	m      sync.Mutex
+	rate   *int64
+	tokens float64
+	last   time.Time
+}
+
+// Takes n tokens out of the bucket. Blocks, until they are available.
+func (b *bucket) wait(n int) {
+	for n>0 {
+		b.m.Lock()
+		rate := float64(atomic.LoadInt64(b.rate))
+		if rate<=0 { b.m.Unlock(); return }
+		now := time.Now()
+		
+		// The bucket holds at most one second worth of tokens.
+		b.tokens += now.Sub(b.last).Seconds()*rate
+		if b.tokens>rate { b.tokens = rate }
+		b.last = now
+		take := float64(n)
+		if take>rate { take = rate }
+		if b.tokens>=take {
+			b.tokens -= take
+			n -= int(take)
+			b.m.Unlock()
+			continue
+		}
+		d := time.Duration((take-b.tokens)/rate*float64(time.Second))
+		b.m.Unlock()
+		time.Sleep(d)
+	}
+}
+
+// A chain of token buckets, that limits a single connection.
+type Limiter struct{
+	b []*bucket
+}
+
+// Blocks, until n bytes may be transferred. A nil Limiter never blocks.
+func (l *Limiter) Wait(n int) {
+	if l==nil { return }
+	for _,b := range l.b { b.wait(n) }
+}
+
+/*
+Bandwidth limits for one direction. There are limits per connection, per peer
+domain and a global one. All rates are in bytes per second, zero means unlimited.
+The rates can be changed at any time and apply to existing connections as well.
+*/
+type Throttle struct{
+	global  int64
+	perConn int64
+	perPeer int64
+	
+	g     bucket
+	m     sync.Mutex
+	peers map[string]*bucket
+}
+
+func (t *Throttle) SetGlobal(rate int64) { atomic.StoreInt64(&t.global,rate) }
+func (t *Throttle) SetPerConn(rate int64) { atomic.StoreInt64(&t.perConn,rate) }
+func (t *Throttle) SetPerPeer(rate int64) { atomic.StoreInt64(&t.perPeer,rate) }
+
+func (t *Throttle) Global() int64 { return atomic.LoadInt64(&t.global) }
+func (t *Throttle) PerConn() int64 { return atomic.LoadInt64(&t.perConn) }
+func (t *Throttle) PerPeer() int64 { return atomic.LoadInt64(&t.perPeer) }
+
+func (t *Throttle) peer(domain string) *bucket {
+	t.m.Lock(); defer t.m.Unlock()
+	if t.peers==nil { t.peers = make(map[string]*bucket) }
+	if domain=="" { return nil }
+	b := t.peers[domain]
+	if b==nil {
+		b = &bucket{rate:&t.perPeer}
+		t.peers[domain] = b
+	}
+	return b
+}
+
+/*
+Creates the Limiter for a new connection. If the domain of the peer is unknown,
+domain is empty and the per-peer limit does not apply.
+A nil Throttle returns a nil Limiter.
+*/
+func (t *Throttle) Limiter(domain string) *Limiter {
+	if t==nil { return nil }
+	t.g.m.Lock()
+	t.g.rate = &t.global
+	t.g.m.Unlock()
+	l := &Limiter{[]*bucket{{rate:&t.perConn}}}
+	if b := t.peer(domain); b!=nil { l.b = append(l.b,b) }
+	l.b = append(l.b,&t.g)
+	return l
+}
@@ -31,9 +31,17 @@ import (
 	"github.com/maxymania/synapse/p2p"
 	"github.com/dhowden/tag"
 	"fmt"
+	"bytes"
+	"image"
+	"image/jpeg"
+	_ "image/png"
 )
 
 var ENoSeekSupport = fmt.Errorf("taglib: no seek support")
+var ENoPicture = fmt.Errorf("taglib: no picture")
+
+// The maximum width and height of a cover thumbnail.
+var ThumbnailSize = 160
 
 type TagMDA int
 
@@ -56,3 +64,45 @@ func (TagMDA) GetMetadata(fs p2p.FileSystem, pth p2p.Path) (bson.Document,error)
 	return doc,err
 }
 
+
+// Returns a thumbnail of the cover picture.
+func (TagMDA) GetPreview(fs p2p.FileSystem, pth p2p.Path) (string,[]byte,error) {
+	f,err := fs.Open(pth)
+	if err!=nil { return "",nil,err }
+	defer f.Close()
+	r,ok := f.(io.ReadSeeker)
+	if !ok { return "",nil,ENoSeekSupport }
+	md,err := tag.ReadFrom(r)
+	if err!=nil { return "",nil,err }
+	pic := md.Picture()
+	if pic==nil || len(pic.Data)==0 { return "",nil,ENoPicture }
+	data,err := thumbnail(pic.Data,ThumbnailSize)
+	if err!=nil { return "",nil,err }
+	return "image/jpeg",data,nil
+}
+
+// Scales the image down (nearest neighbour), so it fits into size x size pixels.
+func thumbnail(data []byte, size int) ([]byte,error) {
+	src,_,err := image.Decode(bytes.NewReader(data))
+	if err!=nil { return nil,err }
+	b := src.Bounds()
+	w,h := b.Dx(),b.Dy()
+	if w>size || h>size {
+		if w>=h {
+			w,h = size,h*size/w
+		} else {
+			w,h = w*size/h,size
+		}
+	}
+	if w<1 { w = 1 }
+	if h<1 { h = 1 }
+	dst := image.NewRGBA(image.Rect(0,0,w,h))
+	for y := 0 ; y<h ; y++ {
+		for x := 0 ; x<w ; x++ {
+			dst.Set(x,y,src.At(b.Min.X+x*b.Dx()/w,b.Min.Y+y*b.Dy()/h))
+		}
+	}
+	buf := new(bytes.Buffer)
+	err = jpeg.Encode(buf,dst,&jpeg.Options{Quality:75})
+	return buf.Bytes(),err
+}
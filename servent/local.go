@@ -0,0 +1,88 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package servent
+
+import (
+	bson "github.com/mad-day/bsonbox/bsoncore"
+	"github.com/maxymania/synapse/c2s"
+	"github.com/maxymania/synapse/ftse"
+	"github.com/maxymania/synapse/p2p"
+)
+
+// The token, under which our own files are published in the local index.
+type localToken string
+func (t localToken) Status() c2s.Status { return c2s.Accepted }
+func (t localToken) Domain() string { return string(t) }
+
+/*
+A search index over our own shares. It is built with the same keyword logic
+as the index servers, so peers can search us without one.
+*/
+type localIndex struct{
+	share
+	idx ftse.FTSI
+	tok localToken
+}
+
+func newLocalIndex(sh share, domain string) *localIndex {
+	l := &localIndex{share:sh,tok:localToken(domain)}
+	l.idx.Dir = new(ftse.MemDir)
+	return l
+}
+
+func (l *localIndex) build() {
+	for _,dir := range l.fs.Dirs() {
+		fils,_ := l.fs.Files(dir)
+		pths := make([]p2p.Path,len(fils))
+		for i,file := range fils { pths[i] = p2p.Path{dir,file} }
+		l.publish(pths)
+	}
+}
+
+func (l *localIndex) publish(pths []p2p.Path) {
+	for _,pth := range pths {
+		if l.hide(pth) { continue }
+		l.idx.Publish(l.tok,l.metadata(pth))
+	}
+}
+
+func (l *localIndex) retract(pths []p2p.Path) {
+	for _,pth := range pths {
+		doc := bson.NewDocumentBuilder().AppendString("_",pth[0]).AppendString("f",pth[1]).Build()
+		l.idx.Retract(l.tok,doc)
+	}
+}
+
+func (l *localIndex) search(terms bson.Document, max int) (res []p2p.SearchResult) {
+	elems,_ := l.idx.Query(l.tok,terms,max).Elements()
+	for _,elem := range elems {
+		doc,ok := elem.Value().DocumentOK()
+		if !ok { continue }
+		var r p2p.SearchResult
+		r.Path[0],_ = doc.Lookup("_").StringValueOK()
+		r.Path[1],_ = doc.Lookup("f").StringValueOK()
+		r.Meta = doc
+		res = append(res,r)
+	}
+	return
+}
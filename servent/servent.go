@@ -37,23 +37,10 @@ import (
 	"github.com/maxymania/synapse/globals"
 	"time"
 	"sync"
-	"sync/atomic"
 	"strings"
+	"strconv"
 )
 
-type dcTimer struct{
-	*time.Ticker
-	s uint32
-}
-func (t *dcTimer) Stop() {
-	if atomic.SwapUint32(&t.s,1)==0 {
-		t.Ticker.Stop()
-	}
-}
-func tickerNew(d time.Duration) *dcTimer {
-	return &dcTimer{time.NewTicker(d),0}
-}
-
 func stoploop(ctx context.Context,d time.Duration) bool {
 	select {
 	case <- ctx.Done(): return true
@@ -70,6 +57,11 @@ type MetadataAdapter interface{
 	GetMetadata(fs p2p.FileSystem, pth p2p.Path) (bson.Document,error)
 }
 
+// Optionally implemented by a MetadataAdapter, that can create previews of files.
+type PreviewAdapter interface{
+	GetPreview(fs p2p.FileSystem, pth p2p.Path) (mime string, data []byte, err error)
+}
+
 type FileFilter interface{
 	HideFile(pth p2p.Path) bool
 }
@@ -80,7 +72,10 @@ func doHide(ff FileFilter, pth p2p.Path) bool {
 
 type DefaultFileFilter string
 func (dff DefaultFileFilter) HideFile(pth p2p.Path) bool {
-	if strings.HasPrefix(pth[1],".") { return true }
+	// Hidden files and the contents of hidden folders.
+	for _,seg := range strings.Split(pth[1],"/") {
+		if strings.HasPrefix(seg,".") { return true }
+	}
 	if dff=="" { return false }
 	exts := strings.Split(string(dff),";")
 	p := strings.ToLower(pth[1])
@@ -98,6 +93,38 @@ type ServentConfig struct{
 	Arena  proto.Allocator
 	KP     proto.KeyPair
 	Dialer proxy.Dialer
+	
+	// If set, the content hash ("h") and the size ("s") of every file are published.
+	Hash   bool
+	
+	// Optional. Receives the events of all downloads.
+	OnEvent func(ev p2p.Event)
+	
+	// Optional bandwidth limits. They can be adjusted at runtime.
+	Upload   *p2p.Throttle
+	Download *p2p.Throttle
+	
+	// Optional. Limits the number of concurrent uploads.
+	Slots    *p2p.Slots
+	
+	// Optional. Verifies peers, that log in to our p2p server (see server.PeerConnectAuth).
+	PeerAuth    p2p.PeerAuth
+	RequireAuth bool
+	Allow       func(peer *p2p.Peer, pth p2p.Path) bool
+	
+	// If set, we log in to the peers, we download from.
+	Login  bool
+	
+	// Keepalive and idle timeout of the p2p connections (see p2p.ClientContext).
+	Keepalive   time.Duration
+	IdleTimeout time.Duration
+	
+	// Optional. Receives the instant messages from other peers.
+	Inbox  func(m *p2p.Message) error
+	
+	// Optional. Called, if an index server rejects published entries (see c2s.PublishError)
+	// or publishing fails otherwise. docs is the batch, the error refers to. It is only valid during the call.
+	OnPublishError func(domain string, docs []bson.Document, err error)
 }
 
 const (
@@ -118,23 +145,28 @@ func wakeup(s chan int) {
 	}
 }
 
-type serverConn struct{
-	cli    *c2s.Client
+// The shared files, as they are published.
+type share struct{
 	fs     p2p.FileSystemEx
 	ff     FileFilter
 	mda    MetadataAdapter
+	hc     *p2p.HashCache
+}
+
+type serverConn struct{
+	share
+	cli    *c2s.Client
 	alive  chan int
 	signal chan int
 	queue  chan fsev
 	status c2s.Status
 	commit bool
+	onerr  func(docs []bson.Document, err error)
 }
-func serverConn_new(cli *c2s.Client,fs p2p.FileSystemEx, ff FileFilter, mda MetadataAdapter) (s *serverConn) {
+func serverConn_new(cli *c2s.Client,fs p2p.FileSystemEx, ff FileFilter, mda MetadataAdapter, hc *p2p.HashCache) (s *serverConn) {
 	s = new(serverConn)
 	s.cli = cli
-	s.fs = fs
-	s.ff = ff
-	s.mda = mda
+	s.share = share{fs,ff,mda,hc}
 	s.alive = make(chan int)
 	s.signal = make(chan int,1)
 	s.queue = make(chan fsev,128)
@@ -148,56 +180,81 @@ func (s *serverConn) Alive() bool {
 	}
 	panic("unreachable")
 }
+// Tells, whether the file must not be published.
+func (s *share) hide(pth p2p.Path) bool {
+	if doHide(s.ff,pth) { return true }
+	df,ok := s.fs.(p2p.DirFilter)
+	return ok && !df.AllowDir(pth[0])
+}
+
+// Creates the document, that is published for a file.
+func (s *share) metadata(pth p2p.Path) bson.Document {
+	doc := bson.Document(nil)
+	var err error
+	if s.mda!=nil {
+		doc,err = s.mda.GetMetadata(s.fs,pth)
+		if err!=nil { doc = nil }
+	}
+	if doc==nil {
+		doc = bson.NewDocumentBuilder().AppendString("_",pth[0]).AppendString("f",pth[1]).Build()
+	}
+	if s.hc!=nil {
+		if h,err := s.hc.Get(s.fs,pth); err==nil { doc = appendHash(doc,h) }
+	}
+	return doc
+}
+
+// Appends the content hash to the metadata document. Existing "h" and "s" fields are replaced.
+func appendHash(doc bson.Document, h *p2p.FileHash) bson.Document {
+	var elems [][]byte
+	all,_ := doc.Elements()
+	for _,elem := range all {
+		k := elem.Key()
+		if k=="h" || k=="s" { continue }
+		elems = append(elems,elem)
+	}
+	elems = append(elems,
+		bson.AppendStringElement(nil,"h",h.Hex()),
+		bson.AppendStringElement(nil,"s",strconv.FormatInt(h.Size,10)))
+	return bson.Document(bson.BuildDocument(nil,elems...))
+}
+
 func (s *serverConn) sendAll() {
 	defer func(){ s.commit = false }()
 	docs := make([]bson.Document,0,1<<9)
-	var err error
 	for _,dir := range s.fs.Dirs() {
 		fils,_ := s.fs.Files(dir)
 		for _,file := range fils {
 			pth := p2p.Path{dir,file}
-			if doHide(s.ff,pth) { continue }
-			doc := bson.Document(nil)
-			if s.mda!=nil {
-				doc,err = s.mda.GetMetadata(s.fs,pth)
-				if err!=nil { doc = nil }
-			}
-			if doc==nil {
-				doc = bson.NewDocumentBuilder().AppendString("_",pth[0]).AppendString("f",pth[1]).Build()
-			}
-			docs = append(docs,doc)
+			if s.hide(pth) { continue }
+			docs = append(docs,s.metadata(pth))
 			if len(docs)<cap(docs) { continue }
-			s.cli.Publish(docs)
+			s.publish(docs)
 			docs = docs[:0]
 		}
 	}
 	if len(docs)>0 {
-		s.cli.Publish(docs)
+		s.publish(docs)
 	}
 }
+func (s *serverConn) publish(docs []bson.Document) {
+	err := s.cli.Publish(docs)
+	if err!=nil && s.onerr!=nil { s.onerr(docs,err) }
+}
 func (s *serverConn) sendMany(pths []p2p.Path) {
 	docs := make([]bson.Document,0,len(pths))
-	var err error
 	for _,pth := range pths {
-		if doHide(s.ff,pth) { continue }
-		doc := bson.Document(nil)
-		if s.mda!=nil {
-			doc,err = s.mda.GetMetadata(s.fs,pth)
-			if err!=nil { doc = nil }
-		}
-		if doc==nil {
-			doc = bson.NewDocumentBuilder().AppendString("_",pth[0]).AppendString("f",pth[1]).Build()
-		}
-		docs = append(docs,doc)
+		if s.hide(pth) { continue }
+		docs = append(docs,s.metadata(pth))
 	}
 	if len(docs)>0 {
-		s.cli.Publish(docs)
+		s.publish(docs)
 	}
 }
 func (s *serverConn) delMany(pths []p2p.Path) {
 	docs := make([]bson.Document,0,len(pths))
 	for _,pth := range pths {
-		if doHide(s.ff,pth) { continue }
+		if s.hide(pth) { continue }
 		doc := bson.NewDocumentBuilder().AppendString("_",pth[0]).AppendString("f",pth[1]).Build()
 		docs = append(docs,doc)
 	}
@@ -206,26 +263,32 @@ func (s *serverConn) delMany(pths []p2p.Path) {
 	}
 }
 
+// Applies the login status. Returns false, if the login was rejected.
+func (s *serverConn) setStatus(status c2s.Status) bool {
+	if s.status!=c2s.Pending { return true } // Done!
+	s.status = status
+	switch status {
+	case c2s.Rejected: return false
+	case c2s.Accepted:
+		s.commit = true
+		go s.sendAll()
+	}
+	return true
+}
+
 func (s *serverConn) serve() {
-	tkc := time.After(time.Nanosecond)
-	// This ticker is a wrapper around time.Ticker that makes it safe to multi-stop it.
-	tk := tickerNew(time.Second)
-	defer tk.Stop()
 	defer close(s.alive)
+	status,err := s.cli.Status()
+	if err!=nil { return }
+	if !s.setStatus(status) { return }
 	for {
 		select {
 		case <- s.signal: // liveness-check
 			_,err := s.cli.Status()
 			if err!=nil { return }
-		case <- tkc: // timer.
-			tkc = tk.C
-			if s.status!=c2s.Pending { tk.Stop(); continue } // Done!
-			status2,err := s.cli.Status()
-			if err!=nil { return }
-			s.status = status2
-			if status2==c2s.Rejected { return }
-			s.commit = true
-			go s.sendAll()
+		case status,ok := <- s.cli.Pushed(): // pushed by the server, once the login is verified.
+			if !ok { return }
+			if !s.setStatus(status) { return }
 		case f := <- s.queue: // queue
 			if s.status!=c2s.Accepted { continue }
 			if s.commit { continue } // s.sendAll is active
@@ -241,6 +304,8 @@ func (s *serverConn) serve() {
 
 type Servent struct{
 	ServentConfig
+	hashes *p2p.HashCache
+	local  *localIndex
 	srv    *p2p.Server
 	cli    *p2p.ClientContext
 	idxcli *c2s.ClientContext
@@ -254,8 +319,29 @@ type Servent struct{
 func (cfg *ServentConfig) Create() *Servent {
 	s := new(Servent)
 	s.ServentConfig = *cfg
-	s.srv    = &p2p.Server{Arena:s.Arena,FS:s.FS,KP:s.KP}
-	s.cli    = &p2p.ClientContext{Arena:s.Arena,Target:s.TS}
+	s.hashes = new(p2p.HashCache)
+	s.srv    = &p2p.Server{Arena:s.Arena,FS:s.FS,KP:s.KP,Hashes:s.hashes,Upload:s.Upload,Slots:s.Slots}
+	s.srv.Auth,s.srv.RequireAuth,s.srv.Allow = s.PeerAuth,s.RequireAuth,s.Allow
+	s.srv.Inbox = s.Inbox
+	s.srv.Keepalive,s.srv.IdleTimeout = s.Keepalive,s.IdleTimeout
+	
+	// The local index sees all files. The server filters the results for each peer.
+	fs := s.FS
+	if acl,ok := fs.(*p2p.ACL); ok { fs = acl.FS }
+	var hc *p2p.HashCache
+	if s.Hash { hc = s.hashes }
+	s.local  = newLocalIndex(share{fs,s.FF,s.MDA,hc},s.KP.Domain)
+	s.srv.Search = s.local.search
+	go s.local.build()
+	s.srv.Hide = func(pth p2p.Path) bool { return doHide(s.FF,pth) }
+	if s.MDA!=nil {
+		s.srv.Meta = s.MDA.GetMetadata
+	}
+	if pa,ok := s.MDA.(PreviewAdapter); ok {
+		s.srv.Preview = pa.GetPreview
+	}
+	s.cli    = &p2p.ClientContext{Arena:s.Arena,Target:s.TS,OnEvent:s.OnEvent,Download:s.Download}
+	s.cli.Keepalive,s.cli.IdleTimeout = s.Keepalive,s.IdleTimeout
 	s.idxcli = &c2s.ClientContext{Arena:s.Arena,KP:s.KP}
 	return s
 }
@@ -294,9 +380,15 @@ func (s *Servent) GetClient(domain string) (*p2p.Client,error) {
 	conn,err := s.Dialer.Dial("tcp",addr)
 	if err!=nil { return nil,err }
 	
-	cli,err = s.cli.NewClient(conn)
+	cli,err = s.cli.NewPeerClient(conn,domain)
 	if err!=nil { conn.Close(); return nil,err } // This should not happen!
 	
+	if s.Login {
+		dataerr,err := cli.Login(&s.KP)
+		if err==nil { err = dataerr }
+		if err!=nil { cli.Close(); return nil,err }
+	}
+	
 	s.cllck.RLock()
 	raw,toolate := s.clist.LoadOrStore(domain,cli)
 	s.cllck.RUnlock()
@@ -309,6 +401,27 @@ func (s *Servent) GetClient(domain string) (*p2p.Client,error) {
 	
 	return cli,nil
 }
+// Sends an instant message to the peer. It returns, once the peer has acknowledged it.
+func (s *Servent) SendMessage(domain, text string) (*p2p.Message,error) {
+	cli,err := s.GetClient(domain)
+	if err!=nil { return nil,err }
+	m,dataerr,err := cli.SendMessage(s.KP.Domain,text)
+	if err==nil { err = dataerr }
+	return m,err
+}
+
+/*
+Returns the round-trip time to the peer, as measured by the keepalive pings.
+ok is false, if there is no open connection or no measurement yet.
+*/
+func (s *Servent) RTT(domain string) (rtt time.Duration, ok bool) {
+	raw,_ := s.clist.Load(domain)
+	cli,_ := raw.(*p2p.Client)
+	if cli==nil || !cli.Alive() { return }
+	rtt = cli.RTT()
+	return rtt,rtt>0
+}
+
 func (s *Servent) RemoveClient(domain string) {
 	raw,_ := s.clist.Load(domain)
 	cli,ok := raw.(*p2p.Client)
@@ -345,7 +458,12 @@ func (s *Servent) getConnection(domain string) (*serverConn,error){
 	lcli,err := s.idxcli.NewClient(conn)
 	if err!=nil { return nil,err }
 	
-	cli = serverConn_new(lcli,s.FS,s.FF,s.MDA)
+	var hc *p2p.HashCache
+	if s.Hash { hc = s.hashes }
+	cli = serverConn_new(lcli,s.view(domain),s.FF,s.MDA,hc)
+	if s.OnPublishError!=nil {
+		cli.onerr = func(docs []bson.Document, err error) { s.OnPublishError(domain,docs,err) }
+	}
 	
 	s.idxlck.RLock()
 	raw,toolate := s.idxlist.LoadOrStore(domain,cli)
@@ -361,6 +479,18 @@ func (s *Servent) getConnection(domain string) (*serverConn,error){
 	
 	return cli,nil
 }
+/*
+Returns the FileSystem, that is published to the index server. If FS is a
+p2p.ACL, the index server sees, what a peer with its domain would see.
+*/
+func (s *Servent) view(domain string) p2p.FileSystemEx {
+	fsp,ok := s.FS.(p2p.FileSystemPeer)
+	if !ok { return s.FS }
+	fse,ok := fsp.ForPeer(&p2p.Peer{Domain:domain}).(p2p.FileSystemEx)
+	if !ok { return s.FS }
+	return fse
+}
+
 func (s *Servent) AddServer(domain string) (error) {
 	_,err := s.getConnection(domain)
 	return err
@@ -406,7 +536,50 @@ func (s *Servent) Query(terms bson.Document,maxPerConn int) (res []bson.Element,
 	if len(res)>0 { err = nil }
 	return
 }
+/*
+Fetches the metadata of a file, that a peer shares, optionally with a preview.
+*/
+func (s *Servent) GetMeta(domain string, pth p2p.Path, preview bool) (*p2p.FileMeta,error) {
+	cli,err := s.GetClient(domain)
+	if err!=nil { return nil,err }
+	m,dataerr,err := cli.GetMeta(pth,preview)
+	if err==nil { err = dataerr }
+	return m,err
+}
+
+/*
+Searches the shared files of a peer directly, without an index server.
+*/
+func (s *Servent) SearchPeer(domain string, terms bson.Document, max int) ([]p2p.SearchResult,error) {
+	cli,err := s.GetClient(domain)
+	if err!=nil { return nil,err }
+	res,dataerr,err := cli.Search(terms,max)
+	if err==nil { err = dataerr }
+	return res,err
+}
+
+/*
+Searches all peers, we are connected to. The results are keyed by domain.
+*/
+func (s *Servent) SearchPeers(terms bson.Document, max int) map[string][]p2p.SearchResult {
+	res := make(map[string][]p2p.SearchResult)
+	s.clist.Range(func(key, value interface{}) bool {
+		dom,_ := key.(string)
+		cli,_ := value.(*p2p.Client)
+		if cli==nil { return true }
+		r,dataerr,err := cli.Search(terms,max)
+		if err==nil && dataerr==nil && len(r)>0 { res[dom] = r }
+		return true
+	})
+	return res
+}
+
 func (s *Servent) update(pths []p2p.Path, what int) {
+	if what==what_remove {
+		s.local.retract(pths)
+	} else {
+		s.local.publish(pths)
+	}
 	conns := s.obtainConnections()
 	for _,conn := range conns {
 		select {
@@ -0,0 +1,246 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package servent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+	"time"
+	bson "github.com/mad-day/bsonbox/bsoncore"
+	
+	"github.com/maxymania/synapse/p2p"
+)
+
+var ENoSources = errors.New("servent: no usable sources")
+
+// How long a single piece may take, before its source is dropped.
+var PieceTimeout = 2*time.Minute
+
+// A peer sharing a file.
+type Source struct{
+	Domain string
+	Path   p2p.Path
+}
+
+/*
+Finds all peers, that published a file with the given content hash (in hex).
+*/
+func (s *Servent) QueryHash(hash string, maxPerConn int) ([]Source,error) {
+	terms := bson.NewDocumentBuilder().AppendString("h",hash).Build()
+	res,err := s.Query(terms,maxPerConn)
+	var srcs []Source
+	seen := make(map[Source]bool)
+	for _,elem := range res {
+		doc,ok := elem.Value().DocumentOK()
+		if !ok { continue }
+		if h,_ := doc.Lookup("h").StringValueOK(); h!=hash { continue }
+		var src Source
+		src.Domain = elem.Key()
+		src.Path[0],_ = doc.Lookup("_").StringValueOK()
+		src.Path[1],_ = doc.Lookup("f").StringValueOK()
+		if seen[src] { continue }
+		seen[src] = true
+		srcs = append(srcs,src)
+	}
+	return srcs,err
+}
+
+/*
+-------------------------------------------------------------------------------
+*                                Piece transfer
+-------------------------------------------------------------------------------
+*/
+
+// Receives a single piece. It is passed as token to p2p.Client.Fetch.
+type piece struct{
+	m    sync.Mutex
+	idx  int
+	max  int64
+	buf  bytes.Buffer
+	done chan error
+	gone bool
+}
+var _ p2p.TokenTarget = (*piece)(nil)
+var _ p2p.TargetWriter = (*piece)(nil)
+
+func (p *piece) Open(pth p2p.Path, off int64) (io.WriteCloser,error) { return p,nil }
+func (p *piece) Write(b []byte) (int,error) {
+	p.m.Lock(); defer p.m.Unlock()
+	if p.gone { return 0,p2p.EDlRejected }
+	if int64(p.buf.Len()+len(b))>p.max { return 0,p2p.EIntegrity }
+	return p.buf.Write(b)
+}
+func (p *piece) finish(err error) {
+	select {
+	case p.done <- err:
+	default:
+	}
+}
+func (p *piece) Close() error { p.finish(nil); return nil }
+func (p *piece) Abort(err error) error { p.finish(err); return nil }
+
+// Abandons the piece. Data, that arrives later, is discarded.
+func (p *piece) abandon() {
+	p.m.Lock(); defer p.m.Unlock()
+	p.gone = true
+}
+
+type pieceResult struct{
+	src  Source
+	idx  int
+	data []byte
+	err  error
+}
+
+/*
+-------------------------------------------------------------------------------
+*                                    Swarm
+-------------------------------------------------------------------------------
+*/
+
+type swarm struct{
+	*Servent
+	hash *p2p.FileHash
+	w    io.WriteCloser
+	
+	// Used, if the target does not support io.WriterAt.
+	next int
+	held map[int][]byte
+}
+
+func (sw *swarm) fetch(src Source, idx int, res chan <- pieceResult) {
+	r := pieceResult{src:src,idx:idx}
+	defer func(){ res <- r }()
+	cli,err := sw.GetClient(src.Domain)
+	if err!=nil { r.err = err; return }
+	off,n := sw.hash.PieceRange(idx)
+	p := &piece{idx:idx,max:n,done:make(chan error,1)}
+	id,dataerr,err := cli.Fetch(p,src.Path,off,n)
+	if err==nil { err = dataerr }
+	if err!=nil { r.err = err; return }
+	select {
+	case r.err = <- p.done:
+	case <- time.After(PieceTimeout):
+		// Stop the server from sending the rest of the piece.
+		p.abandon()
+		cli.Cancel(id)
+		r.err = p2p.ETruncated
+		return
+	}
+	if r.err!=nil { return }
+	sum := sha256.Sum256(p.buf.Bytes())
+	if int64(p.buf.Len())!=n || !bytes.Equal(sum[:],sw.hash.Pieces[idx]) {
+		r.err = p2p.EIntegrity
+		return
+	}
+	r.data = p.buf.Bytes()
+}
+
+func (sw *swarm) store(idx int, data []byte) (err error) {
+	if wa,ok := sw.w.(io.WriterAt); ok {
+		off,_ := sw.hash.PieceRange(idx)
+		_,err = wa.WriteAt(data,off)
+		return
+	}
+	sw.held[idx] = data
+	for {
+		data,ok := sw.held[sw.next]
+		if !ok { return }
+		delete(sw.held,sw.next)
+		sw.next++
+		_,err = sw.w.Write(data)
+		if err!=nil { return }
+	}
+}
+
+func (sw *swarm) run(srcs []Source) error {
+	res := make(chan pieceResult,len(srcs))
+	pending := make([]int,len(sw.hash.Pieces))
+	for i := range pending { pending[i] = i }
+	idle := append([]Source(nil),srcs...)
+	busy := 0
+	for len(pending)>0 || busy>0 {
+		for len(pending)>0 && len(idle)>0 {
+			go sw.fetch(idle[0],pending[0],res)
+			idle,pending = idle[1:],pending[1:]
+			busy++
+		}
+		if busy==0 { return ENoSources }
+		r := <- res
+		busy--
+		if r.err!=nil {
+			// The source is dropped, the piece is retried with another one.
+			pending = append(pending,r.idx)
+			continue
+		}
+		idle = append(idle,r.src)
+		err := sw.store(r.idx,r.data)
+		if err!=nil {
+			// Wait for the remaining transfers, before giving up.
+			for ; busy>0 ; busy-- { <- res }
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Downloads a file from several peers in parallel. The file is identified by its
+content hash. Every piece is verified against the piece hashes, and peers, that
+are slow or send corrupt data, are dropped. The file is written into the
+TargetStore as dst.
+*/
+func (s *Servent) Swarm(tok p2p.Token, root []byte, dst p2p.Path, srcs []Source) error {
+	var fh *p2p.FileHash
+	for _,src := range srcs {
+		cli,err := s.GetClient(src.Domain)
+		if err!=nil { continue }
+		h,dataerr,err := cli.GetHash(src.Path)
+		if err!=nil || dataerr!=nil { continue }
+		if !bytes.Equal(h.Root,root) { continue }
+		fh = h
+		break
+	}
+	if fh==nil { return ENoSources }
+	
+	w,err := s.TS.Create(tok,dst)
+	if err!=nil { return err }
+	sw := &swarm{Servent:s,hash:fh,w:w,held:make(map[int][]byte)}
+	err = sw.run(srcs)
+	if err!=nil {
+		if tw,ok := w.(p2p.TargetWriter); ok { tw.Abort(err) } else { w.Close() }
+		return err
+	}
+	return w.Close()
+}
+
+// Like Swarm, but the content hash is given in hex.
+func (s *Servent) SwarmHex(tok p2p.Token, hash string, dst p2p.Path, srcs []Source) error {
+	root,err := hex.DecodeString(hash)
+	if err!=nil { return err }
+	return s.Swarm(tok,root,dst,srcs)
+}
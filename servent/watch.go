@@ -0,0 +1,234 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package servent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"github.com/fsnotify/fsnotify"
+	"github.com/maxymania/synapse/p2p"
+)
+
+var EWatchUnsupported = errors.New("servent: file system has no local directories to watch")
+
+// Receives the changes of the shared files. Servent implements it.
+type FSEvents interface{
+	Created(pths []p2p.Path)
+	Changed(pths []p2p.Path)
+	Removed(pths []p2p.Path)
+}
+
+var _ FSEvents = (*Servent)(nil)
+
+/*
+Watches the shared directories and reports the changes in batches. Only
+directories of the local file system (see p2p.FileSystemLocal) are watched,
+including their subdirectories. If the watcher reports an error, the shared
+directories are rescanned and all files are reported again.
+*/
+type Watcher struct{
+	// Changes are collected, until nothing happened for that long. Defaults to 2 seconds.
+	Delay time.Duration
+	
+	// A batch is passed on after that long at the latest. Defaults to 10 times Delay.
+	MaxDelay time.Duration
+	
+	fs    p2p.FileSystemEx
+	sink  FSEvents
+	w     *fsnotify.Watcher
+	roots map[string]string // Local directory -> shared directory
+	
+	m       sync.Mutex
+	known   map[p2p.Path]bool
+	pending map[p2p.Path]bool
+}
+
+func NewWatcher(fs p2p.FileSystemEx, sink FSEvents) (*Watcher,error) {
+	fsl,ok := fs.(p2p.FileSystemLocal)
+	if !ok { return nil,EWatchUnsupported }
+	w,err := fsnotify.NewWatcher()
+	if err!=nil { return nil,err }
+	wt := &Watcher{fs:fs,sink:sink,w:w,roots:make(map[string]string),known:make(map[p2p.Path]bool),pending:make(map[p2p.Path]bool)}
+	for _,dir := range fs.Dirs() {
+		local,ok := fsl.LocalDir(dir)
+		if !ok { continue }
+		local = filepath.Clean(local)
+		wt.roots[local] = dir
+		wt.addTree(local)
+		files,_ := fs.Files(dir)
+		for _,f := range files { wt.known[p2p.Path{dir,f}] = true }
+	}
+	return wt,nil
+}
+
+func (wt *Watcher) delay() time.Duration {
+	if wt.Delay<=0 { return 2*time.Second }
+	return wt.Delay
+}
+func (wt *Watcher) maxDelay() time.Duration {
+	if wt.MaxDelay<=0 { return 10*wt.delay() }
+	return wt.MaxDelay
+}
+
+// Watches a directory and all its subdirectories.
+func (wt *Watcher) addTree(local string) {
+	filepath.Walk(local,func(p string, fi os.FileInfo, err error) error {
+		if err==nil && fi.IsDir() { wt.w.Add(p) }
+		return nil
+	})
+}
+
+// Maps a local path to the shared path.
+func (wt *Watcher) path(name string) (p p2p.Path, ok bool) {
+	name = filepath.Clean(name)
+	for local,dir := range wt.roots {
+		rel,err := filepath.Rel(local,name)
+		if err!=nil || rel=="." || strings.HasPrefix(rel,"..") { continue }
+		rel = filepath.ToSlash(rel)
+		if p2p.BadFileName(rel) { continue }
+		return p2p.Path{dir,rel},true
+	}
+	return
+}
+
+func (wt *Watcher) local(p p2p.Path) string {
+	for local,dir := range wt.roots {
+		if dir==p[0] { return filepath.Join(local,filepath.FromSlash(p[1])) }
+	}
+	return ""
+}
+
+func (wt *Watcher) event(ev fsnotify.Event) {
+	if ev.Op==fsnotify.Chmod { return }
+	p,ok := wt.path(ev.Name)
+	if !ok { return }
+	wt.m.Lock(); defer wt.m.Unlock()
+	if ev.Op&fsnotify.Create!=0 {
+		if fi,err := os.Stat(ev.Name); err==nil && fi.IsDir() {
+			// A new directory. Its files are new as well.
+			wt.addTree(ev.Name)
+			filepath.Walk(ev.Name,func(f string, fi os.FileInfo, err error) error {
+				if err!=nil || fi.IsDir() { return nil }
+				if fp,ok := wt.path(f); ok { wt.pending[fp] = true }
+				return nil
+			})
+			return
+		}
+	}
+	if ev.Op&(fsnotify.Remove|fsnotify.Rename)!=0 {
+		// If it was a directory, everything below it is gone.
+		pre := p[1]+"/"
+		for k := range wt.known {
+			if k[0]==p[0] && strings.HasPrefix(k[1],pre) { wt.pending[k] = true }
+		}
+	}
+	wt.pending[p] = true
+}
+
+/*
+Rescans the shared directories, after events may have been lost, e.g. because
+the event queue overflowed. All files are reported again.
+*/
+func (wt *Watcher) rescan() {
+	wt.m.Lock(); defer wt.m.Unlock()
+	for local,dir := range wt.roots {
+		wt.addTree(local)
+		files,_ := wt.fs.Files(dir)
+		for _,f := range files { wt.pending[p2p.Path{dir,f}] = true }
+	}
+	for p := range wt.known { wt.pending[p] = true }
+}
+
+/*
+Compares the pending paths with the local file system and reports,
+what has been created, changed or removed since the last batch.
+*/
+func (wt *Watcher) flush() {
+	wt.m.Lock()
+	var cre,chg,rem []p2p.Path
+	for p := range wt.pending {
+		fi,err := os.Stat(wt.local(p))
+		exists := err==nil && fi.Mode().IsRegular()
+		switch {
+		case exists && wt.known[p]: chg = append(chg,p)
+		case exists:
+			cre = append(cre,p)
+			wt.known[p] = true
+		case wt.known[p]:
+			rem = append(rem,p)
+			delete(wt.known,p)
+		}
+	}
+	wt.pending = make(map[p2p.Path]bool)
+	wt.m.Unlock()
+	if len(rem)>0 { wt.sink.Removed(rem) }
+	if len(cre)>0 { wt.sink.Created(cre) }
+	if len(chg)>0 { wt.sink.Changed(chg) }
+}
+
+// Runs the watcher, until the context is cancelled.
+func (wt *Watcher) Run(ctx context.Context) {
+	defer wt.w.Close()
+	var timer <-chan time.Time
+	var first time.Time
+	for {
+		select {
+		case <- ctx.Done(): return
+		case ev,ok := <- wt.w.Events:
+			if !ok { return }
+			wt.event(ev)
+			now := time.Now()
+			if timer==nil { first = now }
+			wait := wt.delay()
+			if rest := first.Add(wt.maxDelay()).Sub(now); rest<wait { wait = rest }
+			timer = time.After(wait)
+		case _,ok := <- wt.w.Errors:
+			if !ok { return }
+			wt.rescan()
+			timer = nil
+			wt.flush()
+		case <- timer:
+			timer = nil
+			wt.flush()
+		}
+	}
+}
+
+/*
+Watches the shared directories of the servent and publishes the changes,
+until the context is cancelled.
+*/
+func (s *Servent) Watch(ctx context.Context) error {
+	// Watch all directories. Each index server only gets, what it may see.
+	fs := s.FS
+	if acl,ok := fs.(*p2p.ACL); ok { fs = acl.FS }
+	wt,err := NewWatcher(fs,s)
+	if err!=nil { return err }
+	go wt.Run(ctx)
+	return nil
+}
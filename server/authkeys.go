@@ -0,0 +1,130 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"github.com/maxymania/synapse/c2s"
+)
+
+var ENotAuthorized = fmt.Errorf("server: key not authorized")
+
+/*
+How often AuthorizedKeys checks, whether the file has changed.
+*/
+var AuthorizedKeysInterval = time.Second
+
+/*
+A Srv_Auth, that accepts or rejects logins synchronously, based on an
+authorized-keys file. Unlike PeerConnectAuth, it does not need to call the peer back.
+
+Every line of the file contains a domain and a base64 encoded public key,
+separated by white space. Everything after a '#' is a comment.
+A domain may be listed several times with different keys.
+
+The file is reloaded, once it changes.
+*/
+type AuthorizedKeys struct{
+	Path string
+	
+	m       sync.Mutex
+	keys    map[string][][]byte
+	mtime   time.Time
+	size    int64
+	checked time.Time
+	err     error
+}
+var _ c2s.Srv_Auth = (*AuthorizedKeys)(nil)
+
+func parseAuthorizedKeys(f *os.File) (map[string][][]byte,error) {
+	keys := make(map[string][][]byte)
+	sc := bufio.NewScanner(f)
+	for n := 1 ; sc.Scan() ; n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line,'#'); i>=0 { line = line[:i] }
+		flds := strings.Fields(line)
+		if len(flds)==0 { continue }
+		if len(flds)<2 { return nil,fmt.Errorf("server: %s:%d: missing key",f.Name(),n) }
+		pub,err := base64.StdEncoding.DecodeString(flds[1])
+		if err!=nil { return nil,fmt.Errorf("server: %s:%d: %v",f.Name(),n,err) }
+		dom := strings.ToLower(flds[0])
+		keys[dom] = append(keys[dom],pub)
+	}
+	return keys,sc.Err()
+}
+
+func (a *AuthorizedKeys) reload(force bool) error {
+	now := time.Now()
+	if !force && now.Sub(a.checked) < AuthorizedKeysInterval { return a.err }
+	a.checked = now
+	f,err := os.Open(a.Path)
+	if os.IsNotExist(err) {
+		a.keys,a.mtime,a.size,a.err = nil,time.Time{},0,nil
+		return nil
+	}
+	if err!=nil { a.err = err; return err }
+	defer f.Close()
+	fi,err := f.Stat()
+	if err!=nil { a.err = err; return err }
+	if !force && a.keys!=nil && fi.ModTime().Equal(a.mtime) && fi.Size()==a.size { return a.err }
+	
+	// On a parse error, the previous set of keys stays in effect.
+	keys,err := parseAuthorizedKeys(f)
+	a.mtime,a.size,a.err = fi.ModTime(),fi.Size(),err
+	if err!=nil { return err }
+	a.keys = keys
+	return nil
+}
+
+// Reloads the file immediately.
+func (a *AuthorizedKeys) Reload() error {
+	a.m.Lock(); defer a.m.Unlock()
+	return a.reload(true)
+}
+
+// Returns the error of the last reload, if any.
+func (a *AuthorizedKeys) Err() error {
+	a.m.Lock(); defer a.m.Unlock()
+	return a.err
+}
+
+func (a *AuthorizedKeys) authorized(pub []byte, domain string) bool {
+	a.m.Lock(); defer a.m.Unlock()
+	a.reload(false)
+	for _,k := range a.keys[strings.ToLower(domain)] {
+		if bytes.Equal(k,pub) { return true }
+	}
+	return false
+}
+
+func (a *AuthorizedKeys) Login(pub []byte, domain string) c2s.Srv_Token {
+	if a.authorized(pub,domain) { return okToken(domain) }
+	return newToken(c2s.Rejected,domain,ENotAuthorized)
+}
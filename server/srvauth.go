@@ -26,7 +26,9 @@ package server
 import (
 	"net"
 	"io"
-	//"context"
+	"context"
+	"fmt"
+	"time"
 	"golang.org/x/net/proxy"
 	"github.com/maxymania/synapse/c2s"
 	"github.com/maxymania/synapse/p2p"
@@ -47,14 +49,14 @@ type memoizer struct {
 	inner memoizer_i
 	c uint
 }
-func (m memoizer) checkOK(dom string,pub []byte) bool {
+func (m *memoizer) checkOK(dom string,pub []byte) bool {
 	m.RLock(); defer m.RUnlock()
 	opub,ok := m.inner[m.c][dom]
 	if !ok { opub,ok = m.inner[m.c^1][dom] }
 	if !ok { return false }
 	return bytes.Equal(opub,pub)
 }
-func (m memoizer) approve(dom string,pub []byte) {
+func (m *memoizer) approve(dom string,pub []byte) {
 	m.Lock(); defer m.Unlock()
 	ap := m.inner[m.c^1]
 	if ap!=nil { delete(ap,dom) }
@@ -68,23 +70,45 @@ func (m memoizer) approve(dom string,pub []byte) {
 }
 
 type token struct {
+	m    sync.Mutex
 	stat c2s.Status
 	dom  string
+	why  error
+	done chan int
 }
 var _ c2s.Srv_Token = (*token)(nil)
+var _ c2s.Srv_Reason = (*token)(nil)
+var _ c2s.Srv_Notify = (*token)(nil)
 
-func (t *token) Status() c2s.Status { return t.stat }
+func newToken(stat c2s.Status, dom string, why error) *token {
+	t := &token{stat:stat,dom:dom,why:why,done:make(chan int)}
+	if stat!=c2s.Pending { close(t.done) }
+	return t
+}
+func (t *token) lock() func() {
+	t.m.Lock(); return t.m.Unlock
+}
+func (t *token) Status() c2s.Status { defer t.lock()(); return t.stat }
 func (t *token) Domain() string { return t.dom }
-func (t *token) done() {
-	if t.stat==c2s.Pending {
+func (t *token) Reason() error { defer t.lock()(); return t.why }
+func (t *token) Done() <-chan int { return t.done }
+func (t *token) finish(why error) {
+	defer t.lock()()
+	if t.stat!=c2s.Pending { return }
+	if why==nil {
+		t.stat = c2s.Accepted
+	} else {
 		t.stat = c2s.Rejected
+		t.why = why
 	}
+	close(t.done)
 }
 
 type okToken string
 
 func (t okToken) Status() c2s.Status { return c2s.Accepted }
 func (t okToken) Domain() string { return string(t) }
+func (t okToken) Reason() error { return nil }
 var _ c2s.Srv_Token = okToken("")
 
 type notarget int
@@ -97,33 +121,109 @@ var p2pcc = &p2p.ClientContext{Target:notarget(0)}
 type PeerConnectAuth struct{
 	Rand   io.Reader
 	Dialer proxy.Dialer
+	
+	// If set, approved keys are pinned here. Otherwise, they are cached in memory.
+	Trust    TrustStore
+	Conflict ConflictPolicy
+	
+	// Called on a conflict, if Conflict is ConflictAlert.
+	Alert    func(dom string, pinned, offered []byte)
+	
+	// Optional. Called, if the last-seen time of a pinned key can't be written.
+	// The login is accepted anyway.
+	TrustError func(dom string, err error)
+	
+	// Number of concurrent verifications. Defaults to 8.
+	Workers  int
+	
+	// Number of verifications waiting for a worker. Defaults to 256.
+	Backlog  int
+	
+	// Time limit for a single verification. Defaults to 30 seconds.
+	Timeout  time.Duration
+	
+	// How long a failed verification is remembered. Defaults to 5 minutes.
+	FailTTL  time.Duration
+	
 	mem memoizer
+	ver verifier
 }
 var _ c2s.Srv_Auth = (*PeerConnectAuth)(nil)
-
-func verifyPeer(p *PeerConnectAuth, t *token,pub []byte) {
-	defer t.done()
-	addr := net.JoinHostPort(t.dom,globals.Port_p2p)
-	conn,err := p.Dialer.Dial("tcp",addr)
-	if err!=nil { return }
+var _ p2p.PeerAuth = (*PeerConnectAuth)(nil)
+
+func verifyPeer(ctx context.Context, p *PeerConnectAuth, dom string, pub []byte) error {
+	addr := net.JoinHostPort(dom,globals.Port_p2p)
+	var conn net.Conn
+	var err error
+	if cd,ok := p.Dialer.(proxy.ContextDialer); ok {
+		conn,err = cd.DialContext(ctx,"tcp",addr)
+	} else {
+		conn,err = p.Dialer.Dial("tcp",addr)
+	}
+	if err!=nil { return fmt.Errorf("server: dial %s: %v",dom,err) }
+	if dl,ok := ctx.Deadline(); ok { conn.SetDeadline(dl) }
 	cli,err := p2pcc.NewClient(conn)
-	if err!=nil { return }
+	if err!=nil { conn.Close(); return err }
 	defer cli.Close()
+	
+	// Abort the handshake, once the context expires.
+	stop := make(chan int)
+	defer close(stop)
+	go func() {
+		select {
+		case <- ctx.Done(): cli.Close()
+		case <- stop:
+		}
+	}()
+	
 	myrand := p.Rand
 	if myrand==nil { myrand = rand.Reader }
 	sa := &proto.ServerAuth{Rand:myrand}
-	ok,err := cli.AuthStep2(sa,pub,t.dom)
-	if err!=nil || !ok { return }
-	t.stat = c2s.Accepted
+	ok,err := cli.AuthStep2(sa,pub,dom)
+	if ctx.Err()!=nil { return ETimeout }
+	if err!=nil { return err }
+	if !ok { return EAuthFailed }
 	
 	// finally, memoize result to prevent further queries.
-	p.mem.approve(t.dom,pub)
+	if p.Trust!=nil {
+		err = p.Trust.Pin(dom,pub)
+		if err!=nil { return fmt.Errorf("server: pin %s: %v",dom,err) }
+	} else {
+		p.mem.approve(dom,pub)
+	}
+	return nil
 }
-func (p *PeerConnectAuth) Login(pub []byte, domain string) c2s.Srv_Token {
-	if p.mem.checkOK(domain,pub) { return okToken(domain) } // shortcut!
-	t := &token{c2s.Pending,domain}
-	go verifyPeer(p,t,pub)
-	return t
+
+// Checks the login against the trust store. If ok is false, the login must be verified.
+func (p *PeerConnectAuth) checkTrust(pub []byte, domain string) (tok c2s.Srv_Token,ok bool) {
+	e,found := p.Trust.Lookup(domain)
+	if !found { return }
+	if bytes.Equal(e.Pub,pub) {
+		if err := p.Trust.Seen(domain); err!=nil && p.TrustError!=nil {
+			p.TrustError(domain,err)
+		}
+		return okToken(domain),true
+	}
+	switch p.Conflict {
+	case ConflictReverify: return
+	case ConflictAlert:
+		if p.Alert!=nil { p.Alert(domain,e.Pub,pub) }
+	}
+	return newToken(c2s.Rejected,domain,EKeyConflict),true
 }
 
+func (p *PeerConnectAuth) Login(pub []byte, domain string) c2s.Srv_Token {
+	if p.Trust!=nil {
+		if tok,ok := p.checkTrust(pub,domain); ok { return tok }
+	} else if p.mem.checkOK(domain,pub) { return okToken(domain) } // shortcut!
+	return p.ver.submit(p,domain,pub)
+}
 
+// Verifies a peer, that logs in to a p2p.Server. It waits for the verification to finish.
+func (p *PeerConnectAuth) VerifyPeer(domain string, pub []byte) error {
+	tok := p.Login(pub,domain)
+	if n,ok := tok.(c2s.Srv_Notify); ok { <- n.Done() }
+	if tok.Status()==c2s.Accepted { return nil }
+	if r,ok := tok.(c2s.Srv_Reason); ok && r.Reason()!=nil { return r.Reason() }
+	return EAuthFailed
+}
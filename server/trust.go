@@ -0,0 +1,173 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A pinned domain→pubkey pair.
+type TrustEntry struct{
+	Domain    string
+	Pub       []byte
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+/*
+A TrustStore remembers approved domain→pubkey pairs (trust on first use).
+*/
+type TrustStore interface{
+	// Returns the entry pinned for the domain, if any.
+	Lookup(dom string) (TrustEntry,bool)
+	
+	// Pins the public key for the domain, replacing any previous pin.
+	Pin(dom string, pub []byte) error
+	
+	// Updates the last-seen timestamp of the domain.
+	Seen(dom string) error
+	
+	// Removes the pin of the domain.
+	Revoke(dom string) error
+	
+	// Lists all pinned entries.
+	List() []TrustEntry
+}
+
+// What PeerConnectAuth does, if a domain logs in with a key, that differs from the pinned one.
+type ConflictPolicy int
+const (
+	// Reject the login.
+	ConflictReject ConflictPolicy = iota
+	
+	// Verify the new key. On success, the pin is replaced.
+	ConflictReverify
+	
+	// Reject the login and report it to PeerConnectAuth.Alert.
+	ConflictAlert
+)
+
+// How often TrustFile writes last-seen updates to disk.
+var TrustSeenInterval = time.Minute
+
+/*
+A disk-backed TrustStore. The entries are stored as JSON-file.
+*/
+type TrustFile struct{
+	path  string
+	m     sync.Mutex
+	e     map[string]*TrustEntry
+	saved time.Time
+}
+var _ TrustStore = (*TrustFile)(nil)
+
+/*
+Opens the trust store at the given path. A missing file is treated as an empty store.
+*/
+func OpenTrustFile(path string) (*TrustFile,error) {
+	t := &TrustFile{path:path,e:make(map[string]*TrustEntry)}
+	data,err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) { return t,nil }
+	if err!=nil { return nil,err }
+	var list []TrustEntry
+	err = json.Unmarshal(data,&list)
+	if err!=nil { return nil,err }
+	for i := range list {
+		t.e[list[i].Domain] = &list[i]
+	}
+	return t,nil
+}
+
+func (t *TrustFile) lock() func() {
+	t.m.Lock(); return t.m.Unlock
+}
+
+func (t *TrustFile) list() []TrustEntry {
+	list := make([]TrustEntry,0,len(t.e))
+	for _,e := range t.e { list = append(list,*e) }
+	sort.Slice(list,func(i,j int) bool { return list[i].Domain<list[j].Domain })
+	return list
+}
+
+// Writes the store into a temporary file and renames it over the original one.
+func (t *TrustFile) save() error {
+	data,err := json.MarshalIndent(t.list(),"","\t")
+	if err!=nil { return err }
+	dir,name := filepath.Split(t.path)
+	f,err := ioutil.TempFile(dir,"."+name+".")
+	if err!=nil { return err }
+	_,err = f.Write(data)
+	if err==nil { err = f.Sync() }
+	if e := f.Close(); err==nil { err = e }
+	if err==nil { err = os.Rename(f.Name(),t.path) }
+	if err!=nil { os.Remove(f.Name()); return err }
+	t.saved = time.Now()
+	return nil
+}
+
+func (t *TrustFile) Lookup(dom string) (TrustEntry,bool) {
+	defer t.lock()()
+	e,ok := t.e[dom]
+	if !ok { return TrustEntry{},false }
+	return *e,true
+}
+
+func (t *TrustFile) Pin(dom string, pub []byte) error {
+	defer t.lock()()
+	now := time.Now()
+	t.e[dom] = &TrustEntry{dom,append([]byte(nil),pub...),now,now}
+	return t.save()
+}
+
+func (t *TrustFile) Seen(dom string) error {
+	defer t.lock()()
+	e,ok := t.e[dom]
+	if !ok { return nil }
+	e.LastSeen = time.Now()
+	if e.LastSeen.Sub(t.saved) < TrustSeenInterval { return nil }
+	return t.save()
+}
+
+func (t *TrustFile) Revoke(dom string) error {
+	defer t.lock()()
+	if _,ok := t.e[dom]; !ok { return nil }
+	delete(t.e,dom)
+	return t.save()
+}
+
+func (t *TrustFile) List() []TrustEntry {
+	defer t.lock()()
+	return t.list()
+}
+
+// Writes pending last-seen updates to disk.
+func (t *TrustFile) Flush() error {
+	defer t.lock()()
+	return t.save()
+}
@@ -0,0 +1,140 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"github.com/maxymania/synapse/c2s"
+)
+
+var EAuthFailed = fmt.Errorf("server: peer failed to authenticate")
+var EKeyConflict = fmt.Errorf("server: key differs from pinned key")
+var EQueueFull = fmt.Errorf("server: verification queue ran full")
+var ETimeout = fmt.Errorf("server: verification timed out")
+
+type failure struct{
+	why   error
+	until time.Time
+}
+
+// A pending verification. Every login for the same domain+key joins it.
+type verification struct{
+	dom  string
+	pub  []byte
+	toks []*token
+}
+
+type verifier struct{
+	m    sync.Mutex
+	once sync.Once
+	jobs chan *verification
+	run  map[string]*verification
+	neg  map[string]failure
+}
+
+func vkey(dom string, pub []byte) string {
+	return dom+"\x00"+string(pub)
+}
+
+func (p *PeerConnectAuth) timeout() time.Duration {
+	if p.Timeout<=0 { return 30*time.Second }
+	return p.Timeout
+}
+func (p *PeerConnectAuth) failTTL() time.Duration {
+	if p.FailTTL<=0 { return 5*time.Minute }
+	return p.FailTTL
+}
+
+func (v *verifier) start(p *PeerConnectAuth) {
+	n,b := p.Workers,p.Backlog
+	if n<=0 { n = 8 }
+	if b<=0 { b = 256 }
+	v.jobs = make(chan *verification,b)
+	v.run = make(map[string]*verification)
+	v.neg = make(map[string]failure)
+	for i := 0 ; i<n ; i++ { go v.worker(p) }
+}
+
+func (v *verifier) worker(p *PeerConnectAuth) {
+	for job := range v.jobs {
+		ctx,cancel := context.WithTimeout(context.Background(),p.timeout())
+		why := verifyPeer(ctx,p,job.dom,job.pub)
+		cancel()
+		v.finish(p,job,why)
+	}
+}
+
+// Returns the reason of a recent failed verification, if any.
+func (v *verifier) failed(key string) error {
+	f,ok := v.neg[key]
+	if !ok { return nil }
+	if time.Now().After(f.until) {
+		delete(v.neg,key)
+		return nil
+	}
+	return f.why
+}
+
+func (v *verifier) remember(key string, f failure) {
+	if len(v.neg) >= MaxCacheEntries {
+		now := time.Now()
+		for k,o := range v.neg {
+			if now.After(o.until) { delete(v.neg,k) }
+		}
+		if len(v.neg) >= MaxCacheEntries { v.neg = make(map[string]failure) }
+	}
+	v.neg[key] = f
+}
+
+func (v *verifier) submit(p *PeerConnectAuth, dom string, pub []byte) c2s.Srv_Token {
+	v.once.Do(func(){ v.start(p) })
+	key := vkey(dom,pub)
+	v.m.Lock(); defer v.m.Unlock()
+	if why := v.failed(key); why!=nil { return newToken(c2s.Rejected,dom,why) }
+	t := newToken(c2s.Pending,dom,nil)
+	if job,ok := v.run[key]; ok {
+		job.toks = append(job.toks,t)
+		return t
+	}
+	job := &verification{dom,append([]byte(nil),pub...),[]*token{t}}
+	select {
+	case v.jobs <- job:
+		v.run[key] = job
+	default:
+		t.finish(EQueueFull)
+	}
+	return t
+}
+
+func (v *verifier) finish(p *PeerConnectAuth, job *verification, why error) {
+	key := vkey(job.dom,job.pub)
+	v.m.Lock()
+	delete(v.run,key)
+	toks := job.toks
+	if why!=nil { v.remember(key,failure{why,time.Now().Add(p.failTTL())}) }
+	v.m.Unlock()
+	for _,t := range toks { t.finish(why) }
+}
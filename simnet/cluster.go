@@ -0,0 +1,141 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package simnet
+
+import (
+	"crypto/rand"
+	"net"
+	"errors"
+	"time"
+	"github.com/maxymania/synapse/c2s"
+	"github.com/maxymania/synapse/ftse"
+	"github.com/maxymania/synapse/globals"
+	"github.com/maxymania/synapse/p2p"
+	"github.com/maxymania/synapse/proto"
+	"github.com/maxymania/synapse/server"
+	"github.com/maxymania/synapse/servent"
+)
+
+var ETimeout = errors.New("simnet: Timeout")
+
+// A servent on the simulated network.
+type Node struct{
+	*servent.Servent
+	Host *Host
+	FS   *MemFS
+	TS   *MemTarget
+	l    *Listener
+}
+
+/*
+Starts a servent. Unless set in cfg, it gets a fresh key pair, an empty
+MemFS and a MemTarget. The Dialer is always the simulated host.
+*/
+func (n *Net) Servent(domain string, cfg servent.ServentConfig) (*Node,error) {
+	nd := &Node{Host:n.Host(domain),FS:new(MemFS),TS:new(MemTarget)}
+	if cfg.FS==nil { cfg.FS = nd.FS }
+	if cfg.TS==nil { cfg.TS = nd.TS }
+	if len(cfg.KP.Pri)==0 {
+		pub,pri,err := proto.GenKeyPair(rand.Reader)
+		if err!=nil { return nil,err }
+		cfg.KP = proto.KeyPair{Pub:pub,Pri:pri}
+	}
+	cfg.KP.Domain = domain
+	cfg.Dialer = nd.Host
+	l,err := nd.Host.Listen(globals.Port_p2p)
+	if err!=nil { return nil,err }
+	nd.l = l
+	nd.Servent = cfg.Create()
+	go l.Serve(func(c net.Conn) { nd.ServeP2PConn(c) })
+	return nd,nil
+}
+
+// Adds a file to the MemFS and publishes it.
+func (nd *Node) Share(dir, file string, data []byte) {
+	nd.FS.Put(dir,file,data)
+	nd.Created([]p2p.Path{{dir,file}})
+}
+
+// Stops accepting connections and closes the open ones.
+func (nd *Node) Close() {
+	nd.l.Close()
+	nd.Host.net.Drop(nd.Host.domain)
+}
+
+// An index server on the simulated network.
+type Index struct{
+	*c2s.Server
+	FTSI *ftse.FTSI
+	Host *Host
+	l    *Listener
+}
+
+// Starts an index server. Logins are verified with server.PeerConnectAuth.
+func (n *Net) IndexServer(domain string) (*Index,error) {
+	ix := &Index{Host:n.Host(domain),FTSI:&ftse.FTSI{Dir:new(ftse.MemDir)}}
+	ix.Server = &c2s.Server{Rand:rand.Reader,Auth:&server.PeerConnectAuth{Dialer:ix.Host},Query:ix.FTSI}
+	l,err := ix.Host.Listen(globals.Port_c2s)
+	if err!=nil { return nil,err }
+	ix.l = l
+	go l.Serve(func(c net.Conn) { ix.Serve(c) })
+	return ix,nil
+}
+
+func (ix *Index) Close() {
+	ix.l.Close()
+	ix.Host.net.Drop(ix.Host.domain)
+}
+
+// Polls cond, until it is true or the time is up.
+func WaitFor(d time.Duration, cond func() bool) error {
+	end := time.Now().Add(d)
+	for !cond() {
+		if time.Now().After(end) { return ETimeout }
+		time.Sleep(10*time.Millisecond)
+	}
+	return nil
+}
+
+// A Token, that reports the end of its download.
+type Waiter struct{
+	done chan error
+}
+var _ p2p.TokenObserver = (*Waiter)(nil)
+
+func NewWaiter() *Waiter { return &Waiter{done:make(chan error,1)} }
+
+func (w *Waiter) Transfer(ev p2p.Event) {
+	if ev.Kind!=p2p.EvDone { return }
+	select {
+	case w.done <- ev.Err:
+	default:
+	}
+}
+
+// Waits for the download to end and returns its error.
+func (w *Waiter) Wait(d time.Duration) error {
+	select {
+	case err := <- w.done: return err
+	case <- time.After(d): return ETimeout
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package simnet
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+	"github.com/maxymania/synapse/p2p"
+)
+
+// An in-memory FileSystem for shared files.
+type MemFS struct{
+	m    sync.RWMutex
+	dirs map[string]map[string][]byte
+}
+var _ p2p.FileSystemRA = (*MemFS)(nil)
+var _ p2p.FileSystemEx = (*MemFS)(nil)
+
+func (fs *MemFS) Put(dir, file string, data []byte) {
+	fs.m.Lock(); defer fs.m.Unlock()
+	if fs.dirs==nil { fs.dirs = make(map[string]map[string][]byte) }
+	d := fs.dirs[dir]
+	if d==nil { d = make(map[string][]byte); fs.dirs[dir] = d }
+	d[file] = data
+}
+
+func (fs *MemFS) Remove(dir, file string) {
+	fs.m.Lock(); defer fs.m.Unlock()
+	delete(fs.dirs[dir],file)
+}
+
+type memFile struct{
+	*bytes.Reader
+}
+func (memFile) Close() error { return nil }
+
+func (fs *MemFS) Open(p p2p.Path) (io.ReadCloser,error) { return fs.OpenRA(p) }
+func (fs *MemFS) OpenRA(p p2p.Path) (p2p.RandomFile,error) {
+	fs.m.RLock(); defer fs.m.RUnlock()
+	d,ok := fs.dirs[p[0]]
+	if !ok { return nil,p2p.ENoDir }
+	data,ok := d[p[1]]
+	if !ok { return nil,p2p.ENoFile }
+	return memFile{bytes.NewReader(data)},nil
+}
+func (fs *MemFS) Dirs() []string {
+	fs.m.RLock(); defer fs.m.RUnlock()
+	z := make([]string,0,len(fs.dirs))
+	for d := range fs.dirs { z = append(z,d) }
+	sort.Strings(z)
+	return z
+}
+func (fs *MemFS) Files(dir string) ([]string,error) {
+	fs.m.RLock(); defer fs.m.RUnlock()
+	d,ok := fs.dirs[dir]
+	if !ok { return nil,p2p.ENoDir }
+	z := make([]string,0,len(d))
+	for f := range d { z = append(z,f) }
+	sort.Strings(z)
+	return z,nil
+}
+
+// An in-memory TargetStore. A file appears, once its download is complete.
+type MemTarget struct{
+	m     sync.Mutex
+	files map[p2p.Path][]byte
+}
+var _ p2p.TargetStore = (*MemTarget)(nil)
+
+func (t *MemTarget) Create(tok p2p.Token, p p2p.Path) (io.WriteCloser,error) {
+	if tok==nil { return nil,p2p.EDlRejected }
+	return &memWriter{t:t,p:p},nil
+}
+
+// Returns a downloaded file.
+func (t *MemTarget) Get(p p2p.Path) ([]byte,bool) {
+	t.m.Lock(); defer t.m.Unlock()
+	data,ok := t.files[p]
+	return data,ok
+}
+
+type memWriter struct{
+	bytes.Buffer
+	t *MemTarget
+	p p2p.Path
+}
+func (w *memWriter) Close() error {
+	w.t.m.Lock(); defer w.t.m.Unlock()
+	if w.t.files==nil { w.t.files = make(map[p2p.Path][]byte) }
+	w.t.files[w.p] = w.Bytes()
+	return nil
+}
+func (w *memWriter) Abort(err error) error { return nil }
@@ -0,0 +1,245 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+An in-process network simulator. Hosts are identified by fake domains and
+talk through in-memory connections, so servents, index servers and p2p
+servers can run in a single process. Latency, dropped connections and
+network partitions can be injected at any time.
+
+The end-to-end scenarios in Scenarios run on top of it. They are run by go test.
+*/
+package simnet
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var ERefused = errors.New("simnet: Connection refused")
+var EUnreachable = errors.New("simnet: Host unreachable")
+var EAddrInUse = errors.New("simnet: Address already in use")
+
+// The properties of the link between two hosts.
+type Link struct{
+	// The one-way delay of each write and its random variation.
+	Latency time.Duration
+	Jitter  time.Duration
+	
+	// The probability, that a write kills the connection.
+	DropRate float64
+}
+
+type pair [2]string
+
+func mkpair(a, b string) pair {
+	if a>b { a,b = b,a }
+	return pair{a,b}
+}
+
+type Net struct{
+	// The properties of all links, that have not been set with SetLink.
+	Default Link
+	
+	m         sync.Mutex
+	listeners map[string]*Listener
+	links     map[pair]Link
+	cut       map[pair]bool
+	conns     map[*conn]bool
+	rnd       *rand.Rand
+}
+
+func New() *Net {
+	return NewSeeded(time.Now().UnixNano())
+}
+
+// Creates a network, whose random faults are reproducible.
+func NewSeeded(seed int64) *Net {
+	return &Net{
+		listeners: make(map[string]*Listener),
+		links: make(map[pair]Link),
+		cut: make(map[pair]bool),
+		conns: make(map[*conn]bool),
+		rnd: rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (n *Net) lock() func() {
+	n.m.Lock(); return n.m.Unlock
+}
+
+// Sets the properties of the link between a and b.
+func (n *Net) SetLink(a, b string, l Link) {
+	defer n.lock()()
+	n.links[mkpair(a,b)] = l
+}
+
+func (n *Net) link(a, b string) Link {
+	defer n.lock()()
+	if l,ok := n.links[mkpair(a,b)]; ok { return l }
+	return n.Default
+}
+
+/*
+Cuts the link between a and b. New connections fail. Open connections stay
+open, but the data is lost, like on a dead Tor circuit.
+*/
+func (n *Net) Partition(a, b string) {
+	defer n.lock()()
+	n.cut[mkpair(a,b)] = true
+}
+
+// Restores the link between a and b.
+func (n *Net) Heal(a, b string) {
+	defer n.lock()()
+	delete(n.cut,mkpair(a,b))
+}
+
+func (n *Net) partitioned(a, b string) bool {
+	defer n.lock()()
+	return n.cut[mkpair(a,b)]
+}
+
+// Closes all open connections of the host. Returns their number.
+func (n *Net) Drop(domain string) int {
+	var victims []*conn
+	n.m.Lock()
+	for c := range n.conns {
+		if c.lhost==domain || c.rhost==domain { victims = append(victims,c) }
+	}
+	n.m.Unlock()
+	for _,c := range victims { c.sever() }
+	return len(victims)
+}
+
+// Returns the number of open connections.
+func (n *Net) Conns() int {
+	defer n.lock()()
+	return len(n.conns)
+}
+
+func (n *Net) chance(p float64) bool {
+	if p<=0 { return false }
+	defer n.lock()()
+	return n.rnd.Float64() < p
+}
+
+func (n *Net) delay(l Link) time.Duration {
+	d := l.Latency
+	if l.Jitter>0 {
+		n.m.Lock()
+		d += time.Duration(n.rnd.Int63n(int64(l.Jitter)))
+		n.m.Unlock()
+	}
+	return d
+}
+
+// A host on the simulated network. It implements proxy.Dialer and proxy.ContextDialer.
+type Host struct{
+	net    *Net
+	domain string
+}
+
+func (n *Net) Host(domain string) *Host { return &Host{n,domain} }
+
+func (h *Host) Domain() string { return h.domain }
+
+func (h *Host) Dial(network, addr string) (net.Conn,error) {
+	return h.DialContext(context.Background(),network,addr)
+}
+
+func (h *Host) DialContext(ctx context.Context, network, addr string) (net.Conn,error) {
+	dom,_,err := net.SplitHostPort(addr)
+	if err!=nil { return nil,err }
+	n := h.net
+	if n.partitioned(h.domain,dom) { return nil,EUnreachable }
+	n.m.Lock()
+	l := n.listeners[addr]
+	n.m.Unlock()
+	if l==nil { return nil,ERefused }
+	
+	// The connection setup takes one round trip.
+	lk := n.link(h.domain,dom)
+	select {
+	case <- time.After(2*n.delay(lk)):
+	case <- ctx.Done(): return nil,ctx.Err()
+	}
+	
+	a,b := newPipe(n,h.domain,dom,simAddr(h.domain+":0"),simAddr(addr))
+	select {
+	case l.accept <- b: return a,nil
+	case <- l.done: return nil,ERefused
+	case <- ctx.Done(): return nil,ctx.Err()
+	}
+}
+
+// Listens on the given port of the host.
+func (h *Host) Listen(port string) (*Listener,error) {
+	addr := net.JoinHostPort(h.domain,port)
+	defer h.net.lock()()
+	if _,ok := h.net.listeners[addr]; ok { return nil,EAddrInUse }
+	l := &Listener{net:h.net,addr:simAddr(addr),accept:make(chan net.Conn),done:make(chan int)}
+	h.net.listeners[addr] = l
+	return l,nil
+}
+
+type simAddr string
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string { return string(a) }
+
+type Listener struct{
+	net    *Net
+	addr   simAddr
+	accept chan net.Conn
+	done   chan int
+	once   sync.Once
+}
+var _ net.Listener = (*Listener)(nil)
+
+func (l *Listener) Accept() (net.Conn,error) {
+	select {
+	case c := <- l.accept: return c,nil
+	case <- l.done: return nil,ERefused
+	}
+}
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		defer l.net.lock()()
+		delete(l.net.listeners,string(l.addr))
+	})
+	return nil
+}
+func (l *Listener) Addr() net.Addr { return l.addr }
+
+// Accepts connections, until the listener is closed.
+func (l *Listener) Serve(handle func(c net.Conn)) {
+	for {
+		c,err := l.Accept()
+		if err!=nil { return }
+		go handle(c)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package simnet
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type timeoutError struct{}
+func (timeoutError) Error() string { return "simnet: i/o timeout" }
+func (timeoutError) Timeout() bool { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type chunk struct{
+	b  []byte
+	at time.Time // When the chunk arrives.
+}
+
+// One direction of a connection.
+type stream struct{
+	m      sync.Mutex
+	c      *sync.Cond
+	q      []chunk
+	eof    bool // Closed by the writer
+	closed bool // Closed by the reader
+	dl     time.Time
+}
+
+func newStream() *stream {
+	s := new(stream)
+	s.c = sync.NewCond(&s.m)
+	return s
+}
+
+func (s *stream) read(b []byte) (int,error) {
+	s.m.Lock(); defer s.m.Unlock()
+	for {
+		if s.closed { return 0,io.ErrClosedPipe }
+		now := time.Now()
+		if len(s.q)>0 && !now.Before(s.q[0].at) {
+			n := copy(b,s.q[0].b)
+			s.q[0].b = s.q[0].b[n:]
+			if len(s.q[0].b)==0 { s.q = s.q[1:] }
+			return n,nil
+		}
+		if len(s.q)==0 && s.eof { return 0,io.EOF }
+		if !s.dl.IsZero() && !now.Before(s.dl) { return 0,timeoutError{} }
+		
+		// Wake up, once the next chunk arrives or the deadline expires.
+		var wake time.Time
+		if len(s.q)>0 { wake = s.q[0].at }
+		if !s.dl.IsZero() && (wake.IsZero() || s.dl.Before(wake)) { wake = s.dl }
+		if !wake.IsZero() {
+			t := time.AfterFunc(wake.Sub(now),s.broadcast)
+			s.c.Wait()
+			t.Stop()
+		} else {
+			s.c.Wait()
+		}
+	}
+}
+
+func (s *stream) broadcast() {
+	s.m.Lock(); defer s.m.Unlock()
+	s.c.Broadcast()
+}
+
+func (s *stream) write(b []byte, at time.Time) error {
+	s.m.Lock(); defer s.m.Unlock()
+	if s.eof || s.closed { return io.ErrClosedPipe }
+	// Chunks never overtake each other.
+	if n := len(s.q); n>0 && at.Before(s.q[n-1].at) { at = s.q[n-1].at }
+	s.q = append(s.q,chunk{append([]byte(nil),b...),at})
+	s.c.Broadcast()
+	return nil
+}
+
+func (s *stream) shut(reader bool) {
+	s.m.Lock(); defer s.m.Unlock()
+	if reader {
+		s.closed = true
+	} else {
+		s.eof = true
+	}
+	s.c.Broadcast()
+}
+
+func (s *stream) deadline(t time.Time) {
+	s.m.Lock(); defer s.m.Unlock()
+	s.dl = t
+	s.c.Broadcast()
+}
+
+// One end of an in-memory connection.
+type conn struct{
+	net    *Net
+	lhost  string
+	rhost  string
+	laddr  simAddr
+	raddr  simAddr
+	in     *stream
+	out    *stream
+	peer   *conn
+	once   sync.Once
+}
+var _ net.Conn = (*conn)(nil)
+
+func newPipe(n *Net, lhost, rhost string, laddr, raddr simAddr) (a, b *conn) {
+	s1,s2 := newStream(),newStream()
+	a = &conn{net:n,lhost:lhost,rhost:rhost,laddr:laddr,raddr:raddr,in:s1,out:s2}
+	b = &conn{net:n,lhost:rhost,rhost:lhost,laddr:raddr,raddr:laddr,in:s2,out:s1}
+	a.peer,b.peer = b,a
+	defer n.lock()()
+	n.conns[a] = true
+	n.conns[b] = true
+	return
+}
+
+func (c *conn) Read(b []byte) (int,error) { return c.in.read(b) }
+
+func (c *conn) Write(b []byte) (int,error) {
+	n := c.net
+	if n.partitioned(c.lhost,c.rhost) { return len(b),nil } // The data is lost.
+	lk := n.link(c.lhost,c.rhost)
+	if n.chance(lk.DropRate) {
+		c.sever()
+		return 0,io.ErrClosedPipe
+	}
+	err := c.out.write(b,time.Now().Add(n.delay(lk)))
+	if err!=nil { return 0,err }
+	return len(b),nil
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		c.in.shut(true)
+		c.out.shut(false)
+		defer c.net.lock()()
+		delete(c.net.conns,c)
+	})
+	return nil
+}
+
+// Kills the connection on both ends.
+func (c *conn) sever() {
+	c.Close()
+	c.peer.Close()
+}
+
+func (c *conn) LocalAddr() net.Addr { return c.laddr }
+func (c *conn) RemoteAddr() net.Addr { return c.raddr }
+func (c *conn) SetDeadline(t time.Time) error { c.in.deadline(t); return nil }
+func (c *conn) SetReadDeadline(t time.Time) error { c.in.deadline(t); return nil }
+func (c *conn) SetWriteDeadline(t time.Time) error { return nil } // Writes never block.
@@ -0,0 +1,257 @@
+/*
+Copyright (c) 2021 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package simnet
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+	bson "github.com/mad-day/bsonbox/bsoncore"
+	"github.com/maxymania/synapse/p2p"
+	"github.com/maxymania/synapse/servent"
+)
+
+/*
+-------------------------------------------------------------------------------
+*                            End-to-End Scenarios
+-------------------------------------------------------------------------------
+*/
+
+// An end-to-end scenario. It gets a fresh network.
+type Scenario struct{
+	Name string
+	Run  func(n *Net) error
+}
+
+var Scenarios = []Scenario{
+	{"publish-query-download",PublishQueryDownload},
+	{"direct-search",DirectSearch},
+	{"messaging",Messaging},
+	{"latency",Latency},
+	{"partition",Partition},
+	{"drop",DropTransfer},
+}
+
+const timeout = 10*time.Second
+
+// Deterministic file content.
+func payload(n int) []byte {
+	b := make([]byte,n)
+	for i := range b { b[i] = byte(i*7+i/251) }
+	return b
+}
+
+func terms(f string) bson.Document {
+	return bson.NewDocumentBuilder().AppendString("f",f).Build()
+}
+
+// Downloads a file and checks its content.
+func fetch(from *Node, to *Node, pth p2p.Path, want []byte) error {
+	cli,err := to.GetClient(from.Host.Domain())
+	if err!=nil { return err }
+	w := NewWaiter()
+	dataerr,err := cli.GetFile(w,pth)
+	if err==nil { err = dataerr }
+	if err!=nil { return err }
+	if err = w.Wait(timeout); err!=nil { return err }
+	got,ok := to.TS.Get(pth)
+	if !ok || !bytes.Equal(got,want) { return fmt.Errorf("simnet: %v: content mismatch",pth) }
+	return nil
+}
+
+/*
+Alice publishes a file to the index server. Bob finds it with a query and
+downloads it from Alice.
+*/
+func PublishQueryDownload(n *Net) error {
+	ix,err := n.IndexServer("index.sim")
+	if err!=nil { return err }
+	defer ix.Close()
+	alice,err := n.Servent("alice.sim",servent.ServentConfig{})
+	if err!=nil { return err }
+	defer alice.Close()
+	bob,err := n.Servent("bob.sim",servent.ServentConfig{})
+	if err!=nil { return err }
+	defer bob.Close()
+	
+	data := payload(300000)
+	alice.FS.Put("music","song.ogg",data)
+	if err = alice.AddServer("index.sim"); err!=nil { return err }
+	if err = bob.AddServer("index.sim"); err!=nil { return err }
+	
+	var res []bson.Element
+	err = WaitFor(timeout,func() bool {
+		res,_ = bob.Query(terms("song"),10)
+		return len(res)>0
+	})
+	if err!=nil { return fmt.Errorf("query: %v",err) }
+	if res[0].Key()!="alice.sim" { return fmt.Errorf("query: unexpected domain %q",res[0].Key()) }
+	doc,_ := res[0].Value().DocumentOK()
+	var pth p2p.Path
+	pth[0],_ = doc.Lookup("_").StringValueOK()
+	pth[1],_ = doc.Lookup("f").StringValueOK()
+	return fetch(alice,bob,pth,data)
+}
+
+// Bob searches Alice directly. There is no index server.
+func DirectSearch(n *Net) error {
+	alice,err := n.Servent("alice.sim",servent.ServentConfig{})
+	if err!=nil { return err }
+	defer alice.Close()
+	bob,err := n.Servent("bob.sim",servent.ServentConfig{})
+	if err!=nil { return err }
+	defer bob.Close()
+	
+	alice.Share("docs","manual.pdf",payload(1000))
+	alice.Share("docs","notes.txt",payload(10))
+	res,err := bob.SearchPeer("alice.sim",terms("manual"),10)
+	if err!=nil { return err }
+	if len(res)!=1 || res[0].Path!=(p2p.Path{"docs","manual.pdf"}) {
+		return fmt.Errorf("search: unexpected results %v",res)
+	}
+	return nil
+}
+
+// Bob sends Alice a message and gets an acknowledgement.
+func Messaging(n *Net) error {
+	inbox := make(chan *p2p.Message,1)
+	alice,err := n.Servent("alice.sim",servent.ServentConfig{Inbox:func(m *p2p.Message) error {
+		inbox <- m
+		return nil
+	}})
+	if err!=nil { return err }
+	defer alice.Close()
+	bob,err := n.Servent("bob.sim",servent.ServentConfig{})
+	if err!=nil { return err }
+	defer bob.Close()
+	
+	sent,err := bob.SendMessage("alice.sim","hello")
+	if err!=nil { return err }
+	select {
+	case m := <- inbox:
+		if m.ID!=sent.ID || m.Text!="hello" || m.From!="bob.sim" {
+			return fmt.Errorf("message: unexpected %+v",m)
+		}
+	case <- time.After(timeout): return ETimeout
+	}
+	return nil
+}
+
+// A download over slow links. The keepalive pings measure the round-trip time.
+func Latency(n *Net) error {
+	n.Default = Link{Latency:30*time.Millisecond,Jitter:10*time.Millisecond}
+	cfg := servent.ServentConfig{Keepalive:100*time.Millisecond}
+	alice,err := n.Servent("alice.sim",cfg)
+	if err!=nil { return err }
+	defer alice.Close()
+	bob,err := n.Servent("bob.sim",cfg)
+	if err!=nil { return err }
+	defer bob.Close()
+	
+	data := payload(100000)
+	alice.Share("music","slow.ogg",data)
+	if err = fetch(alice,bob,p2p.Path{"music","slow.ogg"},data); err!=nil { return err }
+	
+	var rtt time.Duration
+	err = WaitFor(timeout,func() bool {
+		rtt,_ = bob.RTT("alice.sim")
+		return rtt>0
+	})
+	if err!=nil { return fmt.Errorf("rtt: %v",err) }
+	if rtt<60*time.Millisecond { return fmt.Errorf("rtt: %v is below the link latency",rtt) }
+	return nil
+}
+
+/*
+The link between Alice and Bob is cut. The keepalive notices the dead
+connection, and Bob reconnects, once the link is restored.
+*/
+func Partition(n *Net) error {
+	cfg := servent.ServentConfig{Keepalive:50*time.Millisecond}
+	alice,err := n.Servent("alice.sim",cfg)
+	if err!=nil { return err }
+	defer alice.Close()
+	bob,err := n.Servent("bob.sim",cfg)
+	if err!=nil { return err }
+	defer bob.Close()
+	
+	data := payload(1000)
+	alice.Share("docs","a.txt",data)
+	cli,err := bob.GetClient("alice.sim")
+	if err!=nil { return err }
+	
+	n.Partition("alice.sim","bob.sim")
+	if err = WaitFor(timeout,func() bool { return !cli.Alive() }); err!=nil {
+		return fmt.Errorf("dead connection not detected: %v",err)
+	}
+	if _,err = bob.GetClient("alice.sim"); err!=EUnreachable {
+		return fmt.Errorf("dial across partition: %v",err)
+	}
+	n.Heal("alice.sim","bob.sim")
+	return fetch(alice,bob,p2p.Path{"docs","a.txt"},data)
+}
+
+/*
+Alice's connections are dropped during a download. The download must fail
+without leaving a file behind. A second attempt succeeds.
+*/
+func DropTransfer(n *Net) error {
+	n.Default = Link{Latency:time.Millisecond}
+	alice,err := n.Servent("alice.sim",servent.ServentConfig{})
+	if err!=nil { return err }
+	defer alice.Close()
+	bob,err := n.Servent("bob.sim",servent.ServentConfig{})
+	if err!=nil { return err }
+	defer bob.Close()
+	
+	data := payload(4<<20)
+	pth := p2p.Path{"video","big.mkv"}
+	alice.Share(pth[0],pth[1],data)
+	cli,err := bob.GetClient("alice.sim")
+	if err!=nil { return err }
+	w := NewWaiter()
+	started := make(chan int)
+	var once bool
+	dataerr,err := cli.GetFile(&dropToken{w,func(ev p2p.Event) {
+		if ev.Kind==p2p.EvProgress && !once { once = true; close(started) }
+	}},pth)
+	if err==nil { err = dataerr }
+	if err!=nil { return err }
+	select {
+	case <- started:
+	case <- time.After(timeout): return ETimeout
+	}
+	n.Drop("alice.sim")
+	if err = w.Wait(timeout); err==nil { return fmt.Errorf("drop: download succeeded") }
+	if _,ok := bob.TS.Get(pth); ok { return fmt.Errorf("drop: partial file was committed") }
+	return fetch(alice,bob,pth,data)
+}
+
+type dropToken struct{
+	*Waiter
+	on func(ev p2p.Event)
+}
+func (t *dropToken) Transfer(ev p2p.Event) {
+	t.on(ev)
+	t.Waiter.Transfer(ev)
+}